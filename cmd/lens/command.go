@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/clarkzjw/starlink-lens/pkg/geoip"
+)
+
+// runCommand runs a lens subcommand, e.g. `lens location export`, and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "location":
+		return locationCommand(args[1:])
+	case "config":
+		return configCommand(args[1:])
+	case "verify":
+		return verifyCommand(args[1:])
+	case "geoip":
+		return geoipCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+// locationCommand implements
+//
+//	lens location export [-format gpx|geojson] location-<datetime>.jsonl
+func locationCommand(args []string) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintln(os.Stderr, "usage: lens location export [-format gpx|geojson] <track.jsonl>")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("location export", flag.ContinueOnError)
+	format := fs.String("format", "gpx", "Export format, gpx or geojson")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: lens location export [-format gpx|geojson] <track.jsonl>")
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	track, err := readTrack(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	name := strings.TrimSuffix(path.Base(fs.Arg(0)), ".jsonl")
+	switch *format {
+	case "gpx":
+		err = writeGPX(os.Stdout, name, track)
+	case "geojson":
+		err = writeGeoJSON(os.Stdout, name, track)
+	default:
+		err = fmt.Errorf("unknown export format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// configCommand implements
+//
+//	lens config check [-config config.toml]
+//
+// which validates the config file and environment overrides and prints the effective config
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: lens config check [-config config.toml]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	filename := fs.String("config", *configFile, "Path to the config file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	c, err := readConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	effective := c.Redacted()
+	effective.Ping.Targets = c.pingTargets(nil)
+	if len(c.Terminals) > 0 {
+		effective.Terminals = c.terminals()
+	}
+	if err := toml.NewEncoder(os.Stdout).Encode(effective); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := c.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\ninvalid config:\n%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// verifyCommand implements
+//
+//	lens verify [-config config.toml] [-remote] [-checksum] [-date YYYY-MM-DD] [manifest.json ...]
+//
+// which checks the files listed in manifests for missing, corrupted and orphaned files,
+// either in the data directory and upload spool, or with -remote in the object store
+func verifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	filename := fs.String("config", *configFile, "Path to the config file")
+	remote := fs.Bool("remote", false, "Verify the objects in the object store instead of local files")
+	checksum := fs.Bool("checksum", false, "Download remote objects to compare their SHA256, not only their size")
+	date := fs.String("date", "", "Only verify the manifest of this day (YYYY-MM-DD)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c, err := readConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ClientName = c.ClientName
+
+	var reports []*VerifyReport
+	if *remote {
+		reports, err = verifyRemoteManifests(c, *date, *checksum)
+	} else {
+		reports, err = verifyLocalManifests(c, *date, fs.Args())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	code := 0
+	for _, r := range reports {
+		for _, f := range r.Missing {
+			fmt.Printf("missing   %s\n", f)
+		}
+		for _, f := range r.Corrupted {
+			fmt.Printf("corrupted %s\n", f)
+		}
+		for _, f := range r.Orphaned {
+			fmt.Printf("orphaned  %s\n", f)
+		}
+		fmt.Printf("%s: %d files, %d uploaded, %d missing, %d corrupted, %d orphaned\n",
+			r.Manifest, r.Files, r.Uploaded, len(r.Missing), len(r.Corrupted), len(r.Orphaned))
+		if !r.ok() {
+			code = 1
+		}
+	}
+	return code
+}
+
+func verifyLocalManifests(c *Config, date string, filenames []string) ([]*VerifyReport, error) {
+	pattern := manifestFilename("*")
+	local, err := filepath.Glob(path.Join(c.manifestDir(), pattern))
+	if err != nil {
+		return nil, err
+	}
+	spooled, err := filepath.Glob(path.Join(c.spoolDir(), c.ClientName, "manifest", "*", "*", "*", pattern))
+	if err != nil {
+		return nil, err
+	}
+	all := append(local, spooled...)
+	if len(filenames) == 0 {
+		filenames = all
+	}
+
+	listed := make(map[string]bool)
+	for _, filename := range append(all, filenames...) {
+		m, err := readManifestFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		for _, e := range m.Files {
+			listed[path.Clean(e.File)] = true
+		}
+	}
+
+	reports := make([]*VerifyReport, 0, len(filenames))
+	for _, filename := range filenames {
+		m, err := readManifestFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if date != "" && m.Date != date {
+			continue
+		}
+		reports = append(reports, verifyLocal(m, filename, c.DataDir, c.spoolDir(), listed))
+	}
+	if len(reports) == 0 {
+		return nil, errors.New("no manifest found")
+	}
+	return reports, nil
+}
+
+func verifyRemoteManifests(c *Config, date string, checksum bool) ([]*VerifyReport, error) {
+	u, err := NewUploader(c)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("no upload backend is configured")
+	}
+	store, ok := u.(RemoteStore)
+	if !ok {
+		return nil, fmt.Errorf("upload backend %q can not read objects back", c.uploadBackend())
+	}
+
+	ctx := context.Background()
+	objects, err := store.List(ctx, c.ClientName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, c.ClientName+"/manifest/") && (date == "" || path.Base(key) == manifestFilename(date)) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no manifest found")
+	}
+	slices.Sort(keys)
+
+	reports := make([]*VerifyReport, 0, len(keys))
+	for _, key := range keys {
+		body, err := store.Open(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		m, err := readManifest(body)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		reports = append(reports, verifyRemote(ctx, store, objects, m, key, checksum))
+	}
+	return reports, nil
+}
+
+// geoipCommand implements
+//
+//	lens geoip list [-config config.toml]
+//	lens geoip diff [-config config.toml] [old [new]]
+//
+// which list the snapshots of the GeoIP feed, and report the PoPs and prefixes that changed between two snapshots.
+// A snapshot is given by its file, or by a date (YYYY-MM-DD) or time (RFC 3339) for the latest snapshot taken until then.
+// diff compares the two latest snapshots without arguments, and a snapshot with the latest one with a single argument.
+func geoipCommand(args []string) int {
+	usage := "usage: lens geoip list|diff [-config config.toml] [old [new]]"
+	if len(args) == 0 || (args[0] != "list" && args[0] != "diff") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("geoip "+args[0], flag.ContinueOnError)
+	filename := fs.String("config", *configFile, "Path to the config file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if (args[0] == "list" && fs.NArg() > 0) || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	c, err := readConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	snapshots, err := geoip.ListSnapshots(c.geoipSnapshotDir())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "list" {
+		for _, s := range snapshots {
+			entries, err := geoip.LoadSnapshot(s.Filename)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Printf("%s  %6d prefixes  %s\n", s.Time.Format(time.RFC3339), len(entries), s.Filename)
+		}
+		return 0
+	}
+
+	var from, to geoip.Snapshot
+	switch fs.NArg() {
+	case 0:
+		if len(snapshots) < 2 {
+			fmt.Fprintf(os.Stderr, "%d snapshots in %s, at least 2 are needed\n", len(snapshots), c.geoipSnapshotDir())
+			return 1
+		}
+		from, to = snapshots[len(snapshots)-2], snapshots[len(snapshots)-1]
+	case 1:
+		if len(snapshots) == 0 {
+			fmt.Fprintf(os.Stderr, "no snapshots in %s\n", c.geoipSnapshotDir())
+			return 1
+		}
+		from, err = findSnapshot(snapshots, fs.Arg(0))
+		to = snapshots[len(snapshots)-1]
+	case 2:
+		from, err = findSnapshot(snapshots, fs.Arg(0))
+		if err == nil {
+			to, err = findSnapshot(snapshots, fs.Arg(1))
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	before, err := geoip.LoadSnapshot(from.Filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	after, err := geoip.LoadSnapshot(to.Filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printGeoIPDiff(from, to, geoip.Compare(before, after))
+	return 0
+}
+
+// findSnapshot returns the snapshot in the file arg, or the latest snapshot taken until the date or time arg
+func findSnapshot(snapshots []geoip.Snapshot, arg string) (geoip.Snapshot, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return geoip.Snapshot{Filename: arg}, nil
+	}
+
+	until, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		day, dayErr := time.Parse(time.DateOnly, arg)
+		if dayErr != nil {
+			return geoip.Snapshot{}, fmt.Errorf("%q is neither a snapshot file, nor a date or time", arg)
+		}
+		until = day.Add(24*time.Hour - time.Second)
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Time.After(until) {
+			return snapshots[i], nil
+		}
+	}
+	return geoip.Snapshot{}, fmt.Errorf("no snapshot taken until %s", until.Format(time.RFC3339))
+}
+
+func snapshotName(s geoip.Snapshot) string {
+	if s.Time.IsZero() {
+		return s.Filename
+	}
+	return fmt.Sprintf("%s (%s)", s.Filename, s.Time.Format(time.RFC3339))
+}
+
+func printGeoIPDiff(from, to geoip.Snapshot, d *geoip.Diff) {
+	fmt.Printf("--- %s\n+++ %s\n", snapshotName(from), snapshotName(to))
+	for _, p := range d.AddedPoPs {
+		fmt.Printf("added PoP       %s (%s)\n", p.Pop, p.City)
+	}
+	for _, p := range d.RemovedPoPs {
+		fmt.Printf("removed PoP     %s (%s)\n", p.Pop, p.City)
+	}
+	for _, p := range d.AddedPrefixes {
+		fmt.Printf("added prefix    %s %s (%s)\n", p.CIDR, p.Pop, p.City)
+	}
+	for _, p := range d.RemovedPrefixes {
+		fmt.Printf("removed prefix  %s %s (%s)\n", p.CIDR, p.Pop, p.City)
+	}
+	for _, m := range d.Moved {
+		fmt.Printf("moved prefix    %s %s (%s) -> %s (%s)\n", m.Prefix, m.From.Pop, m.From.City, m.To.Pop, m.To.City)
+	}
+	fmt.Printf("%d PoPs added, %d removed, %d prefixes added, %d removed, %d moved\n",
+		len(d.AddedPoPs), len(d.RemovedPoPs), len(d.AddedPrefixes), len(d.RemovedPrefixes), len(d.Moved))
+}
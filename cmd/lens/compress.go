@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// compressedExtension returns the extension of files written by compress
+func compressedExtension() string {
+	ext := ".zst"
+	if CompressionFormat == CompressionGzip {
+		ext = ".gz"
+	}
+	if CompressionTar {
+		ext = ".tar" + ext
+	}
+	return ext
+}
+
+func newCompressWriter(w io.Writer) (io.WriteCloser, error) {
+	if CompressionFormat == CompressionGzip {
+		level := gzip.DefaultCompression
+		if CompressionLevel != 0 {
+			level = CompressionLevel
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	level := zstd.SpeedDefault
+	if CompressionLevel != 0 {
+		level = zstd.EncoderLevelFromZstd(CompressionLevel)
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+}
+
+// compress compresses directory/filename into the same directory, removes the original file and
+// returns the name of the compressed file. The files in bundle, e.g. session metadata, are added to
+// the tar archive after filename and kept, they are ignored without CompressionTar.
+// The result is written to a temporary file first and renamed when complete,
+// so that an interrupted compression never leaves a truncated archive behind.
+func compress(directory, filename string, bundle ...string) (string, error) {
+	fullFilename := path.Join(directory, filename)
+	fileInfo, err := os.Stat(fullFilename)
+	if err != nil {
+		return "", fmt.Errorf("error stating file %s: %w", fullFilename, err)
+	}
+	if fileInfo.Size() == 0 {
+		return "", fmt.Errorf("%s is empty, skipping compression", fullFilename)
+	}
+
+	filenames := []string{filename}
+	if CompressionTar {
+		filenames = append(filenames, bundle...)
+	}
+
+	compressedFilename := fullFilename + compressedExtension()
+	tmp, err := os.CreateTemp(directory, "."+filename+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeCompressed(tmp, directory, filenames); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("error compressing %s: %w", fullFilename, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), compressedFilename); err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(fullFilename); err != nil {
+		return compressedFilename, fmt.Errorf("error removing %s: %w", fullFilename, err)
+	}
+	return compressedFilename, nil
+}
+
+// writeCompressed writes the files in directory to w, inside a tar archive when CompressionTar is set,
+// or only the first file as a plain compressed stream otherwise.
+func writeCompressed(w io.Writer, directory string, filenames []string) error {
+	cw, err := newCompressWriter(w)
+	if err != nil {
+		return err
+	}
+
+	if !CompressionTar {
+		err = copyFile(cw, path.Join(directory, filenames[0]))
+	} else {
+		tw := tar.NewWriter(cw)
+		for _, filename := range filenames {
+			if err = writeTarFile(tw, directory, filename); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+	}
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+func copyFile(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// writeTarFile adds directory/filename to tw. The tar header only depends on the name, size and
+// modification time of the file, so that archives are identical regardless of the host they are created on.
+func writeTarFile(tw *tar.Writer, directory, filename string) error {
+	f, err := os.Open(path.Join(directory, filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filename,
+		Size:     fileInfo.Size(),
+		Mode:     0644,
+		ModTime:  fileInfo.ModTime().UTC().Truncate(time.Second),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -1,134 +1,814 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/clarkzjw/starlink-lens/pkg/geoip"
 	"github.com/joho/godotenv"
+	"github.com/phuslu/log"
+	"github.com/robfig/cron/v3"
 )
 
 var (
 	defaultDishGRPCAddress  = "192.168.100.1:9200"
+	defaultConfigFile       = "config.toml"
 	grpcTimeout             = 5 * time.Second
 	defaultIPv4CGNATGateway = "100.64.0.1"
+	probeTimeout            = 2 * time.Second
 	sessionDuration         time.Duration
-	externalIPv4            string
-	externalIPv6            string
-
-	ClientName             string
-	StarlinkGateway        string
-	ManualSpecifiedGateway string
-	Duration               string
-	Interval               string
-	IntervalSeconds        float64
-	Iface                  string
-	Count                  int
-	ActiveDish             bool
-	IPv6GatewayHopCount    string
-	CronString             string
-	DataDir                string
-	IRTTHostPort           string
-	IRTTLocalIP            string
-	PoP                    string
-	IPVersion              int
-	EnableIRTT             = false
-
-	DishGrpcAddrPort   string
-	RouterGrpcAddrPort string
-	PingBinary         string
+	pingInterval            time.Duration
+	statusInterval          time.Duration
+	historyInterval         time.Duration
+	locationInterval        time.Duration
+	eventsInterval          time.Duration
+	detectInterval          time.Duration
+
+	// the IPv6 gateway is detected by tracing the path to a gateway trace target,
+	// as the first router outside the prefix Starlink delegates to the terminal
+	gatewayTraceTargets        = map[int]string{4: "ipv4.google.com", 6: "ipv6.google.com"}
+	gatewayTraceMaxHops        = 8
+	starlinkDelegatedPrefixLen = 56
+
+	// unknownPoP tags the files of sessions of a terminal whose PoP is not in the GeoIP feed,
+	// e.g. when the feed could not be downloaded yet
+	unknownPoP = "unknown"
+
+	// terminals are the Starlink terminals measured by this process
+	terminals []*Terminal
+
+	ClientName   string
+	Duration     string
+	Interval     string
+	DataDir      string
+	IRTTHostPort string
+	EnableIRTT   = false
+	PingFormats  []string
+
+	EnableStatus   = false
+	StatusInterval string
+
+	EnableHistory   = false
+	HistoryInterval string
+
+	EnableOutages = false
+
+	EnableLocation   = false
+	LocationInterval string
+
+	MetricsListen string
+
+	ControlSocket string
+	ControlListen string
+	ControlToken  string
 
 	EnableSync = false
 	NotifyURL  string
 
-	EnableSwift    = false
-	SwiftUsername  string
-	SwiftAPIKey    string
-	SwiftAuthURL   string
-	SwiftDomain    string
-	SwiftTenant    string
-	SwiftContainer string
+	EventsInterval  string
+	DetectInterval  string
+	EventsNotifyURL string
+	RestartOnEvents = true
+	WatchLinks      = true
+
+	CompressionFormat = CompressionZstd
+	CompressionLevel  = 0
+	CompressionTar    = true
+
+	UploadBackend string
 )
 
-func getConfigFromEnv() error {
-	err := godotenv.Load()
+// ConfigDuration is a duration that keeps the text it was configured with,
+// as e.g. INTERVAL and DURATION appear verbatim in result file names
+type ConfigDuration struct {
+	time.Duration
+	text string
+}
+
+func (d *ConfigDuration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
 	if err != nil {
-		return fmt.Errorf("error loading .env file: %w", err)
-	}
-
-	DishGrpcAddrPort = os.Getenv("DISH_GRPC_ADDR_PORT")
-	if DishGrpcAddrPort == "" {
-		DishGrpcAddrPort = defaultDishGRPCAddress
-	}
-	RouterGrpcAddrPort = os.Getenv("ROUTER_GRPC_ADDR_PORT")
-	ManualSpecifiedGateway = os.Getenv("MANUAL_GW")
-	Duration = os.Getenv("DURATION")
-	Interval = os.Getenv("INTERVAL")
-	Iface = os.Getenv("IFACE")
-	ActiveDish = os.Getenv("ACTIVE") == "true"
-	IPv6GatewayHopCount = os.Getenv("IPv6GWHop")
-	CronString = os.Getenv("CRON")
-	DataDir = os.Getenv("DATA_DIR")
-	EnableIRTT = os.Getenv("ENABLE_IRTT") == "true"
-	IRTTHostPort = os.Getenv("IRTT_HOST_PORT")
-	IRTTLocalIP = os.Getenv("LOCAL_IP")
-
-	ClientName = os.Getenv("CLIENT_NAME")
-
-	EnableSync = os.Getenv("ENABLE_SYNC") == "true"
-	NotifyURL = os.Getenv("NOTIFY_URL")
-	PingBinary = os.Getenv("PING_BINARY")
-	if PingBinary == "" {
-		PingBinary = "ping"
-	}
-	EnableSwift = os.Getenv("ENABLE_SWIFT") == "true"
-	SwiftUsername = os.Getenv("SWIFT_USERNAME")
-	SwiftAPIKey = os.Getenv("SWIFT_APIKEY")
-	SwiftAuthURL = os.Getenv("SWIFT_AUTHURL")
-	SwiftDomain = os.Getenv("SWIFT_DOMAIN")
-	SwiftTenant = os.Getenv("SWIFT_TENANT")
-	SwiftContainer = os.Getenv("SWIFT_CONTAINER")
+		return err
+	}
+	d.Duration = v
+	d.text = string(b)
 	return nil
 }
 
-func LoadConfig() error {
-	if err := getConfigFromEnv(); err != nil {
-		return err
+func (d ConfigDuration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d ConfigDuration) String() string {
+	if d.text != "" {
+		return d.text
+	}
+	return d.Duration.String()
+}
+
+func configDuration(s string) ConfigDuration {
+	var d ConfigDuration
+	if err := d.UnmarshalText([]byte(s)); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+const (
+	// gatewayTarget is the ping target host that stands for the detected Starlink gateway
+	gatewayTarget = "gateway"
+	// popTarget is the ping target host that stands for the anycast address of the Starlink PoPs
+	popTarget      = "pop"
+	popAnycastHost = "pop.anycast.starlinkisp.net"
+)
+
+// PingTarget is one [[ping.targets]] entry. All targets are probed concurrently in every ping session,
+// Interval and Duration default to ping.interval and ping.duration.
+type PingTarget struct {
+	Name     string         `toml:"name,omitempty" json:"name,omitempty"`
+	Host     string         `toml:"host" json:"host"`
+	Interval ConfigDuration `toml:"interval" json:"interval"`
+	Duration ConfigDuration `toml:"duration" json:"duration"`
+}
+
+// pingTargets fills in the defaults of targets,
+// which are ping.targets, or only the gateway when no target is configured
+func (c *Config) pingTargets(targets []PingTarget) []PingTarget {
+	if len(targets) == 0 {
+		targets = c.Ping.Targets
+	}
+	if len(targets) == 0 {
+		targets = []PingTarget{{Host: gatewayTarget}}
+	}
+	resolved := make([]PingTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.Interval.Duration == 0 {
+			t.Interval = c.Ping.Interval
+		}
+		if t.Duration.Duration == 0 {
+			t.Duration = c.Ping.Duration
+		}
+		resolved = append(resolved, t)
+	}
+	return resolved
+}
+
+// TerminalConfig is one [[terminals]] entry.
+// Empty fields default to the top level settings of the same name.
+type TerminalConfig struct {
+	ID             string       `toml:"id"`
+	Iface          string       `toml:"iface"`
+	Active         *bool        `toml:"active,omitempty"`
+	ManualGateway  string       `toml:"manual_gateway,omitempty"`
+	IPv6GatewayHop int          `toml:"ipv6_gateway_hop,omitzero"`
+	DishGrpc       string       `toml:"dish_grpc,omitempty"`
+	RouterGrpc     string       `toml:"router_grpc,omitempty"`
+	Cron           string       `toml:"cron,omitempty"`
+	LocalIP        string       `toml:"local_ip,omitempty"`
+	PingTargets    []PingTarget `toml:"ping_targets,omitempty"`
+
+	// bindGrpc connects to the gRPC APIs through Iface,
+	// as all dishes answer on the same address
+	bindGrpc bool
+}
+
+// terminals returns the configured terminals with defaults filled in,
+// or a single terminal without ID made of the top level settings when none is configured
+func (c *Config) terminals() []TerminalConfig {
+	if len(c.Terminals) == 0 {
+		active := c.Active
+		return []TerminalConfig{{
+			Iface:          c.Iface,
+			Active:         &active,
+			ManualGateway:  c.ManualGateway,
+			IPv6GatewayHop: c.IPv6GatewayHop,
+			DishGrpc:       c.DishGrpc,
+			RouterGrpc:     c.RouterGrpc,
+			Cron:           c.Cron,
+			LocalIP:        c.IRTT.LocalIP,
+			PingTargets:    c.pingTargets(nil),
+		}}
+	}
+
+	resolved := make([]TerminalConfig, 0, len(c.Terminals))
+	for _, t := range c.Terminals {
+		if t.Active == nil {
+			active := c.Active
+			t.Active = &active
+		}
+		t.IPv6GatewayHop = cmp.Or(t.IPv6GatewayHop, c.IPv6GatewayHop)
+		t.DishGrpc = cmp.Or(t.DishGrpc, c.DishGrpc)
+		t.Cron = cmp.Or(t.Cron, c.Cron)
+		t.LocalIP = cmp.Or(t.LocalIP, c.IRTT.LocalIP)
+		t.PingTargets = c.pingTargets(t.PingTargets)
+		t.bindGrpc = true
+		resolved = append(resolved, t)
+	}
+	return resolved
+}
+
+// Config is the content of config.toml.
+// Every field can be overridden by the environment variable in its env tag, also read from .env.
+type Config struct {
+	ClientName     string `toml:"client_name" env:"CLIENT_NAME"`
+	Iface          string `toml:"iface" env:"IFACE"`
+	Active         bool   `toml:"active" env:"ACTIVE"`
+	ManualGateway  string `toml:"manual_gateway" env:"MANUAL_GW"`
+	IPv6GatewayHop int    `toml:"ipv6_gateway_hop" env:"IPv6GWHop"`
+	Cron           string `toml:"cron" env:"CRON"`
+	DataDir        string `toml:"data_dir" env:"DATA_DIR"`
+	DishGrpc       string `toml:"dish_grpc" env:"DISH_GRPC_ADDR_PORT"`
+	RouterGrpc     string `toml:"router_grpc" env:"ROUTER_GRPC_ADDR_PORT"`
+	NotifyURL      string `toml:"notify_url" env:"NOTIFY_URL"`
+
+	Terminals []TerminalConfig `toml:"terminals"`
+
+	Ping struct {
+		Duration ConfigDuration `toml:"duration" env:"DURATION"`
+		Interval ConfigDuration `toml:"interval" env:"INTERVAL"`
+		Output   []string       `toml:"output" env:"PING_OUTPUT"`
+		Targets  []PingTarget   `toml:"targets" env:"PING_TARGETS"`
+	} `toml:"ping"`
+
+	IRTT struct {
+		Enable   bool   `toml:"enable" env:"ENABLE_IRTT"`
+		HostPort string `toml:"host_port" env:"IRTT_HOST_PORT"`
+		LocalIP  string `toml:"local_ip" env:"LOCAL_IP"`
+	} `toml:"irtt"`
+
+	GeoIP struct {
+		URL       string `toml:"url" env:"GEOIP_URL"`
+		CacheFile string `toml:"cache_file" env:"GEOIP_CACHE_FILE"`
+		SeedFile  string `toml:"seed_file" env:"GEOIP_SEED_FILE"`
+		// SnapshotDir keeps every distinct version of the feed for lens geoip diff
+		SnapshotDir string `toml:"snapshot_dir" env:"GEOIP_SNAPSHOT_DIR"`
+		Offline     bool   `toml:"offline" env:"GEOIP_OFFLINE"`
+	} `toml:"geoip"`
+
+	ExternalIP struct {
+		HTTP    []string       `toml:"http" env:"EXTERNAL_IP_HTTP"`
+		STUN    []string       `toml:"stun" env:"EXTERNAL_IP_STUN"`
+		Timeout ConfigDuration `toml:"timeout" env:"EXTERNAL_IP_TIMEOUT"`
+		Cache   ConfigDuration `toml:"cache" env:"EXTERNAL_IP_CACHE"`
+	} `toml:"external_ip"`
+
+	Status struct {
+		Enable   bool           `toml:"enable" env:"ENABLE_STATUS"`
+		Interval ConfigDuration `toml:"interval" env:"STATUS_INTERVAL"`
+	} `toml:"status"`
+
+	History struct {
+		Enable   bool           `toml:"enable" env:"ENABLE_HISTORY"`
+		Interval ConfigDuration `toml:"interval" env:"HISTORY_INTERVAL"`
+	} `toml:"history"`
+
+	Outages struct {
+		Enable bool `toml:"enable" env:"ENABLE_OUTAGES"`
+	} `toml:"outages"`
+
+	Location struct {
+		Enable   bool           `toml:"enable" env:"ENABLE_LOCATION"`
+		Interval ConfigDuration `toml:"interval" env:"LOCATION_INTERVAL"`
+	} `toml:"location"`
+
+	Events struct {
+		Interval       ConfigDuration `toml:"interval" env:"EVENTS_INTERVAL"`
+		DetectInterval ConfigDuration `toml:"detect_interval" env:"EVENTS_DETECT_INTERVAL"`
+		Restart        bool           `toml:"restart" env:"EVENTS_RESTART"`
+		Netlink        bool           `toml:"netlink" env:"EVENTS_NETLINK"`
+		NotifyURL      string         `toml:"notify_url" env:"EVENTS_NOTIFY_URL"`
+	} `toml:"events"`
+
+	Metrics struct {
+		Listen string `toml:"listen" env:"METRICS_LISTEN"`
+	} `toml:"metrics"`
+
+	Control struct {
+		Socket string `toml:"socket" env:"CONTROL_SOCKET"`
+		Listen string `toml:"listen" env:"CONTROL_LISTEN"`
+		Token  string `toml:"token" env:"CONTROL_TOKEN" secret:"true"`
+	} `toml:"control"`
+
+	Compression struct {
+		Format string `toml:"format" env:"COMPRESSION"`
+		Level  int    `toml:"level" env:"COMPRESSION_LEVEL"`
+		Tar    bool   `toml:"tar" env:"COMPRESSION_TAR"`
+	} `toml:"compression"`
+
+	Sync struct {
+		Enable bool `toml:"enable" env:"ENABLE_SYNC"`
+	} `toml:"sync"`
+
+	Upload struct {
+		Backend  string `toml:"backend" env:"UPLOAD_BACKEND"`
+		SpoolDir string `toml:"spool_dir" env:"UPLOAD_SPOOL_DIR"`
+	} `toml:"upload"`
+
+	Swift struct {
+		Enable    bool   `toml:"enable" env:"ENABLE_SWIFT"`
+		Username  string `toml:"username" env:"SWIFT_USERNAME"`
+		APIKey    string `toml:"api_key" env:"SWIFT_APIKEY" secret:"true"`
+		AuthURL   string `toml:"auth_url" env:"SWIFT_AUTHURL"`
+		Domain    string `toml:"domain" env:"SWIFT_DOMAIN"`
+		Tenant    string `toml:"tenant" env:"SWIFT_TENANT"`
+		Container string `toml:"container" env:"SWIFT_CONTAINER"`
+	} `toml:"swift"`
+
+	S3 struct {
+		Endpoint   string `toml:"endpoint" env:"S3_ENDPOINT"`
+		Region     string `toml:"region" env:"S3_REGION"`
+		Bucket     string `toml:"bucket" env:"S3_BUCKET"`
+		AccessKey  string `toml:"access_key" env:"S3_ACCESS_KEY"`
+		SecretKey  string `toml:"secret_key" env:"S3_SECRET_KEY" secret:"true"`
+		Insecure   bool   `toml:"insecure" env:"S3_INSECURE"`
+		PathStyle  bool   `toml:"path_style" env:"S3_PATH_STYLE"`
+		PartSizeMB int    `toml:"part_size_mb" env:"S3_PART_SIZE_MB"`
+	} `toml:"s3"`
+
+	Presign struct {
+		URL   string `toml:"url" env:"PRESIGN_URL"`
+		Token string `toml:"token" env:"PRESIGN_TOKEN" secret:"true"`
+	} `toml:"presign"`
+}
+
+func (c *Config) spoolDir() string {
+	return cmp.Or(c.Upload.SpoolDir, path.Join(c.DataDir, "spool"))
+}
+
+func (c *Config) geoipCacheFile() string {
+	return cmp.Or(c.GeoIP.CacheFile, path.Join(c.DataDir, "geoip", "pops.csv"))
+}
+
+func (c *Config) geoipSnapshotDir() string {
+	return cmp.Or(c.GeoIP.SnapshotDir, path.Join(c.DataDir, "geoip", "snapshots"))
+}
+
+func (c *Config) manifestDir() string {
+	return path.Join(c.DataDir, "manifests")
+}
+
+// uploadBackend is upload.backend, or swift when only swift.enable is set
+func (c *Config) uploadBackend() string {
+	if c.Upload.Backend == "" && c.Swift.Enable {
+		return UploadBackendSwift
+	}
+	return c.Upload.Backend
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		Cron:     "0 * * * *",
+		DataDir:  "data",
+		DishGrpc: defaultDishGRPCAddress,
+	}
+	c.Ping.Duration = configDuration("1h")
+	c.Ping.Interval = configDuration("10ms")
+	c.Ping.Output = []string{PingFormatText, PingFormatJSONL}
+	c.GeoIP.URL = geoip.DefaultURL
+	c.ExternalIP.HTTP = []string{"https://ifconfig.io/ip", "https://api64.ipify.org", "https://icanhazip.com"}
+	c.ExternalIP.STUN = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+	c.ExternalIP.Timeout = configDuration("5s")
+	c.ExternalIP.Cache = configDuration("5m")
+	c.Status.Interval = configDuration("1s")
+	c.History.Interval = configDuration("5m")
+	c.Location.Interval = configDuration("10s")
+	c.Events.Interval = configDuration("5m")
+	c.Events.DetectInterval = configDuration("1h")
+	c.Events.Restart = true
+	c.Events.Netlink = true
+	c.Compression.Format = CompressionZstd
+	c.Compression.Tar = true
+	c.S3.PartSizeMB = 16
+	return c
+}
+
+// readConfig reads the defaults, the config file if it exists, and the environment overrides, in this order
+func readConfig(filename string) (*Config, error) {
+	c := defaultConfig()
+
+	if filename != "" {
+		md, err := toml.DecodeFile(filename, c)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+		default:
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				keys := make([]string, 0, len(undecoded))
+				for _, k := range undecoded {
+					keys = append(keys, k.String())
+				}
+				return nil, fmt.Errorf("unknown keys in %s: %s", filename, strings.Join(keys, ", "))
+			}
+		}
 	}
 
-	StarlinkGateway = getGateway()
-	if StarlinkGateway == "" {
-		return errors.New("gateway not detected")
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
 	}
+	if err := applyEnv(reflect.ValueOf(c).Elem()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides the fields of a Config struct with the environment variables named in their env tags.
+// Empty variables are ignored, as .env files often leave unused settings empty.
+func applyEnv(v reflect.Value) error {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		sf := v.Type().Field(i)
+
+		name, ok := sf.Tag.Lookup("env")
+		if !ok {
+			if field.Kind() == reflect.Struct {
+				if err := applyEnv(field); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			continue
+		}
+
+		switch p := field.Addr().Interface().(type) {
+		case *string:
+			*p = value
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, value)
+			}
+			*p = b
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", name, value)
+			}
+			*p = n
+		case *[]string:
+			*p = splitList(value)
+		case *ConfigDuration:
+			if err := p.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		case *[]PingTarget:
+			*p = nil
+			for _, host := range splitList(value) {
+				*p = append(*p, PingTarget{Host: host})
+			}
+		default:
+			return fmt.Errorf("%s: unsupported config field type %s", name, field.Type())
+		}
+	}
+	return nil
+}
 
-	if EnableIRTT && IRTTHostPort == "" {
+// splitList splits a comma separated environment variable, e.g. "https://a, https://b",
+// and drops the spaces around the elements and empty elements
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Validate checks the fields and their combinations, it does not depend on the network
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Ping.Duration.Duration <= 0 {
+		//nolint:revive // DURATION
+		errs = append(errs, errors.New("DURATION must be positive"))
+	}
+	if c.Ping.Interval.Duration <= 0 {
+		//nolint:revive // INTERVAL
+		errs = append(errs, errors.New("INTERVAL must be positive"))
+	} else if c.Ping.Interval.Duration > c.Ping.Duration.Duration {
+		//nolint:revive // INTERVAL
+		errs = append(errs, errors.New("INTERVAL must not be longer than DURATION, no probe would be sent"))
+	}
+
+	ids := make(map[string]bool)
+	ifaces := make(map[string]bool)
+	for _, t := range c.terminals() {
+		if len(c.Terminals) > 0 && t.ID == "" {
+			errs = append(errs, fmt.Errorf("terminal on interface %q has no id", t.Iface))
+		}
+		if ids[t.ID] {
+			errs = append(errs, fmt.Errorf("terminal id %q is used twice", t.ID))
+		}
+		ids[t.ID] = true
+		if ifaces[t.Iface] {
+			errs = append(errs, fmt.Errorf("interface %q is used by two terminals", t.Iface))
+		}
+		ifaces[t.Iface] = true
+
+		for _, err := range t.validate() {
+			if t.ID != "" {
+				err = fmt.Errorf("terminal %s: %w", t.ID, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := parsePingFormats(strings.Join(c.Ping.Output, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid PING_OUTPUT: %w", err))
+	}
+
+	if c.IRTT.Enable && c.IRTT.HostPort == "" {
 		//nolint:revive // IRTT_HOST_PORT
-		return errors.New("IRTT_HOST_PORT is not set when ENABLE_IRTT is true")
+		errs = append(errs, errors.New("IRTT_HOST_PORT is not set when ENABLE_IRTT is true"))
+	}
+	if u, err := url.Parse(c.GeoIP.URL); !c.GeoIP.Offline && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		//nolint:revive // GEOIP_URL
+		errs = append(errs, fmt.Errorf("GEOIP_URL %q is not an http(s) URL", c.GeoIP.URL))
+	}
+	if len(c.ExternalIP.HTTP)+len(c.ExternalIP.STUN) == 0 {
+		//nolint:revive // EXTERNAL_IP_*
+		errs = append(errs, errors.New("EXTERNAL_IP_HTTP and EXTERNAL_IP_STUN are both empty"))
+	}
+	for _, endpoint := range c.ExternalIP.HTTP {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			//nolint:revive // EXTERNAL_IP_HTTP
+			errs = append(errs, fmt.Errorf("EXTERNAL_IP_HTTP %q is not an http(s) URL", endpoint))
+		}
+	}
+	for _, server := range c.ExternalIP.STUN {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			//nolint:revive // EXTERNAL_IP_STUN
+			errs = append(errs, fmt.Errorf("EXTERNAL_IP_STUN %q is not a host:port address", server))
+		}
+	}
+	if c.ExternalIP.Timeout.Duration <= 0 {
+		//nolint:revive // EXTERNAL_IP_TIMEOUT
+		errs = append(errs, errors.New("EXTERNAL_IP_TIMEOUT must be positive"))
+	}
+	if c.ExternalIP.Cache.Duration < 0 {
+		//nolint:revive // EXTERNAL_IP_CACHE
+		errs = append(errs, errors.New("EXTERNAL_IP_CACHE must not be negative"))
+	}
+	if c.Status.Enable && c.Status.Interval.Duration < time.Second {
+		//nolint:revive // STATUS_INTERVAL
+		errs = append(errs, errors.New("STATUS_INTERVAL must be at least 1s"))
+	}
+	if c.Location.Enable && c.Location.Interval.Duration < time.Second {
+		//nolint:revive // LOCATION_INTERVAL
+		errs = append(errs, errors.New("LOCATION_INTERVAL must be at least 1s"))
+	}
+	if c.Events.Interval.Duration < time.Minute {
+		//nolint:revive // EVENTS_INTERVAL
+		errs = append(errs, errors.New("EVENTS_INTERVAL must be at least 1m"))
+	}
+	if c.Events.DetectInterval.Duration < c.Events.Interval.Duration {
+		//nolint:revive // EVENTS_DETECT_INTERVAL
+		errs = append(errs, errors.New("EVENTS_DETECT_INTERVAL must not be shorter than EVENTS_INTERVAL"))
+	}
+	if u, err := url.Parse(c.Events.NotifyURL); c.Events.NotifyURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		//nolint:revive // EVENTS_NOTIFY_URL
+		errs = append(errs, fmt.Errorf("EVENTS_NOTIFY_URL %q is not an http(s) URL", c.Events.NotifyURL))
+	}
+	// the dish keeps 900 seconds of per-second history
+	if c.History.Enable && (c.History.Interval.Duration <= 0 || c.History.Interval.Duration >= 15*time.Minute) {
+		//nolint:revive // HISTORY_INTERVAL
+		errs = append(errs, errors.New("HISTORY_INTERVAL must be shorter than 15m to harvest history without gaps"))
+	}
+	if c.Control.Listen != "" && c.Control.Token == "" {
+		//nolint:revive // CONTROL_TOKEN
+		errs = append(errs, errors.New("CONTROL_TOKEN is not set when CONTROL_LISTEN is used"))
+	}
+	switch c.Compression.Format {
+	case CompressionZstd:
+		if c.Compression.Level < 0 || c.Compression.Level > 22 {
+			//nolint:revive // COMPRESSION_LEVEL
+			errs = append(errs, errors.New("COMPRESSION_LEVEL must be between 1 and 22 for zstd, or 0 for the default"))
+		}
+	case CompressionGzip:
+		if c.Compression.Level < 0 || c.Compression.Level > 9 {
+			//nolint:revive // COMPRESSION_LEVEL
+			errs = append(errs, errors.New("COMPRESSION_LEVEL must be between 1 and 9 for gzip, or 0 for the default"))
+		}
+	default:
+		//nolint:revive // COMPRESSION
+		errs = append(errs, fmt.Errorf("COMPRESSION %q is not one of zstd, gzip", c.Compression.Format))
 	}
 
-	if EnableIRTT && IPVersion == 4 && IRTTLocalIP == "" {
-		//nolint:revive // LOCAL_IP
-		return errors.New("LOCAL_IP is not set when ENABLE_IRTT is true and IPv4 is used")
+	backend := c.uploadBackend()
+	if backend != "" && c.ClientName == "" {
+		//nolint:revive // CLIENT_NAME
+		errs = append(errs, errors.New("CLIENT_NAME is not set when uploads are enabled"))
+	}
+	switch backend {
+	case "":
+	case UploadBackendSwift:
+		if c.Swift.Username == "" || c.Swift.APIKey == "" || c.Swift.AuthURL == "" || c.Swift.Container == "" {
+			//nolint:revive // SWIFT_*
+			errs = append(errs, errors.New("SWIFT_USERNAME, SWIFT_APIKEY, SWIFT_AUTHURL and SWIFT_CONTAINER are required for the swift upload backend"))
+		}
+	case UploadBackendS3:
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" || c.S3.AccessKey == "" || c.S3.SecretKey == "" {
+			//nolint:revive // S3_*
+			errs = append(errs, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for the s3 upload backend"))
+		}
+		if c.S3.PartSizeMB < 5 {
+			//nolint:revive // S3_PART_SIZE_MB
+			errs = append(errs, errors.New("S3_PART_SIZE_MB must be at least 5"))
+		}
+	case UploadBackendPresign:
+		if u, err := url.Parse(c.Presign.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			//nolint:revive // PRESIGN_URL
+			errs = append(errs, fmt.Errorf("PRESIGN_URL %q is not an http(s) URL", c.Presign.URL))
+		}
+	default:
+		//nolint:revive // UPLOAD_BACKEND
+		errs = append(errs, fmt.Errorf("UPLOAD_BACKEND %q is not one of swift, s3, presign", backend))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *TerminalConfig) validate() []error {
+	var errs []error
+
+	if t.Iface == "" {
+		//nolint:revive // IFACE
+		errs = append(errs, errors.New("IFACE is not set"))
+	}
+	if t.IPv6GatewayHop < 0 {
+		//nolint:revive // IPv6GWHop
+		errs = append(errs, errors.New("IPv6GWHop must not be negative"))
 	}
 
-	if EnableSwift {
-		if err := TestSwiftConnection(); err != nil {
-			return fmt.Errorf("swift connection test failed: %w", err)
+	schedule, err := cron.ParseStandard(t.Cron)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid CRON %q: %w", t.Cron, err))
+	}
+
+	labels := make(map[string]bool)
+	for _, p := range t.PingTargets {
+		if p.Host == "" {
+			errs = append(errs, fmt.Errorf("ping target %q has no host", p.Name))
+			continue
+		}
+		if p.Interval.Duration <= 0 || p.Duration.Duration <= 0 || p.Interval.Duration > p.Duration.Duration {
+			errs = append(errs, fmt.Errorf("ping target %s: interval %s and duration %s must be positive, and the interval must not be longer than the duration", p.Host, p.Interval, p.Duration))
+		}
+		if schedule != nil {
+			// sessions of consecutive runs must not overlap
+			next := schedule.Next(time.Now())
+			if gap := schedule.Next(next).Sub(next); p.Duration.Duration > gap {
+				errs = append(errs, fmt.Errorf("ping target %s: duration %s is longer than the %s between two runs of CRON %q", p.Host, p.Duration, gap, t.Cron))
+			}
+		}
+		// the output files of the targets are named by name (or host), interval and duration
+		label := fmt.Sprintf("%s-%s-%s", cmp.Or(p.Name, p.Host), p.Interval, p.Duration)
+		if labels[label] {
+			errs = append(errs, fmt.Errorf("ping target %s is configured twice with interval %s and duration %s, give each a distinct name", cmp.Or(p.Name, p.Host), p.Interval, p.Duration))
 		}
+		labels[label] = true
 	}
+	return errs
+}
+
+// Redacted returns a copy of the config with credentials replaced, for printing
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Ping.Output = append([]string(nil), c.Ping.Output...)
+	redact(reflect.ValueOf(&r).Elem())
+	return &r
+}
 
-	var err error
-	sessionDuration, err = time.ParseDuration(Duration)
+func redact(v reflect.Value) {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(ConfigDuration{}) {
+			redact(field)
+			continue
+		}
+		if v.Type().Field(i).Tag.Get("secret") == "true" && field.String() != "" {
+			field.SetString("<redacted>")
+		}
+	}
+}
+
+// apply copies the config to the package level settings
+func (c *Config) apply() {
+	ClientName = c.ClientName
+	DataDir = c.DataDir
+	NotifyURL = c.NotifyURL
+
+	Duration = c.Ping.Duration.String()
+	Interval = c.Ping.Interval.String()
+	sessionDuration = c.Ping.Duration.Duration
+	pingInterval = c.Ping.Interval.Duration
+	formats, err := parsePingFormats(strings.Join(c.Ping.Output, ","))
 	if err != nil {
-		return fmt.Errorf("error parsing Duration: %w", err)
+		// rejected by Validate
+		log.Error().Err(err).Msg("Error parsing ping output formats")
+	}
+	PingFormats = formats
+
+	EnableIRTT = c.IRTT.Enable
+	IRTTHostPort = c.IRTT.HostPort
+
+	externalIPs = NewExternalIPResolver(c.ExternalIP.HTTP, c.ExternalIP.STUN, c.ExternalIP.Timeout.Duration, c.ExternalIP.Cache.Duration)
+
+	EnableStatus = c.Status.Enable
+	StatusInterval = c.Status.Interval.String()
+	statusInterval = c.Status.Interval.Duration
+	EnableHistory = c.History.Enable
+	HistoryInterval = c.History.Interval.String()
+	historyInterval = c.History.Interval.Duration
+	EnableOutages = c.Outages.Enable
+	EnableLocation = c.Location.Enable
+	LocationInterval = c.Location.Interval.String()
+	locationInterval = c.Location.Interval.Duration
+	EventsInterval = c.Events.Interval.String()
+	eventsInterval = c.Events.Interval.Duration
+	DetectInterval = c.Events.DetectInterval.String()
+	detectInterval = c.Events.DetectInterval.Duration
+	EventsNotifyURL = c.Events.NotifyURL
+	RestartOnEvents = c.Events.Restart
+	WatchLinks = c.Events.Netlink
+
+	MetricsListen = c.Metrics.Listen
+	ControlSocket = c.Control.Socket
+	ControlListen = c.Control.Listen
+	ControlToken = c.Control.Token
+
+	CompressionFormat = c.Compression.Format
+	CompressionLevel = c.Compression.Level
+	CompressionTar = c.Compression.Tar
+
+	EnableSync = c.Sync.Enable
+	UploadBackend = c.uploadBackend()
+
+	terminals = nil
+	for _, t := range c.terminals() {
+		terminals = append(terminals, NewTerminal(t))
 	}
-	interval, err := time.ParseDuration(Interval)
+}
+
+func LoadConfig(filename string) error {
+	c, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.apply()
+
+	geoipClient = NewGeoIPClient(c.GeoIP.URL, c.geoipCacheFile(), c.GeoIP.SeedFile, c.geoipSnapshotDir(), c.GeoIP.Offline)
+
+	for _, t := range terminals {
+		if t.DetectGateway() == "" {
+			return fmt.Errorf("gateway not detected%s", t.logSuffix())
+		}
+
+		if _, _, ipVersion := t.Gateway(); EnableIRTT && ipVersion == 4 && t.IRTTLocalIP == "" {
+			//nolint:revive // LOCAL_IP
+			return fmt.Errorf("LOCAL_IP is not set when ENABLE_IRTT is true and IPv4 is used%s", t.logSuffix())
+		}
+	}
+
+	uploader, err := NewUploader(c)
 	if err != nil {
-		return fmt.Errorf("error parsing Interval: %w", err)
+		return err
+	}
+	if uploader != nil {
+		// sites are often offline for hours, results are spooled until the object store is reachable
+		if err := uploader.Check(context.Background()); err != nil {
+			log.Warn().Err(err).Msgf("%s connection test failed, uploads are retried later", UploadBackend)
+		}
+		spool, err = NewUploadSpool(c.spoolDir(), uploader)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifests, err = NewManifestStore(c.manifestDir())
+	if err != nil {
+		return err
 	}
-	Count = int(sessionDuration.Seconds() / (float64(interval.Microseconds()) / 1000.0 / 1000.0))
-	IntervalSeconds = interval.Seconds()
+	// upload the manifests of the days that ended while lens was not running
+	manifests.Finalize()
 
 	return nil
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/phuslu/log"
+)
+
+// ActiveSession is a measurement session that is currently running
+type ActiveSession struct {
+	ID       int    `json:"id"`
+	Terminal string `json:"terminal,omitempty"`
+	Kind     string `json:"kind"`
+	Target   string `json:"target,omitempty"`
+	Start    string `json:"start"`
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	next     int
+	sessions map[int]*ActiveSession
+}
+
+var activeSessions = &sessionRegistry{sessions: make(map[int]*ActiveSession)}
+
+// track registers a running session, the returned function is called when it ends
+func (r *sessionRegistry) track(terminal, kind, target string) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next++
+	id := r.next
+	r.sessions[id] = &ActiveSession{
+		ID:       id,
+		Terminal: terminal,
+		Kind:     kind,
+		Target:   target,
+		Start:    time.Now().UTC().Format(time.RFC3339),
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.sessions, id)
+	}
+}
+
+func (r *sessionRegistry) list() []ActiveSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]ActiveSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+type controlJob struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	NextRun string `json:"next_run,omitempty"`
+	LastRun string `json:"last_run,omitempty"`
+}
+
+// ControlServer is a local HTTP API to inspect and drive the running scheduler
+type ControlServer struct {
+	scheduler gocron.Scheduler
+	token     string
+}
+
+func (c *ControlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs", c.listJobs)
+	mux.HandleFunc("POST /jobs/{name}/run", c.runJob)
+	mux.HandleFunc("POST /ping", c.runTerminalJobs("icmp_ping"))
+	mux.HandleFunc("POST /irtt", c.runTerminalJobs("irtt_ping"))
+	mux.HandleFunc("POST /gateway", c.detectGateway)
+	mux.HandleFunc("GET /sessions", c.listSessions)
+	mux.HandleFunc("GET /config", c.showConfig)
+	return c.authenticate(mux)
+}
+
+// authenticate requires "Authorization: Bearer <token>" when a token is configured
+func (c *ControlServer) authenticate(next http.Handler) http.Handler {
+	if c.token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			writeControlError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug().Err(err).Msg("Error writing control API response")
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	writeControlJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (c *ControlServer) listJobs(w http.ResponseWriter, _ *http.Request) {
+	jobs := make([]controlJob, 0)
+	for _, j := range c.scheduler.Jobs() {
+		job := controlJob{
+			Name: j.Name(),
+			ID:   j.ID().String(),
+		}
+		if t, err := j.NextRun(); err == nil && !t.IsZero() {
+			job.NextRun = t.Format(time.RFC3339)
+		}
+		if t, err := j.LastRun(); err == nil && !t.IsZero() {
+			job.LastRun = t.Format(time.RFC3339)
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+	writeControlJSON(w, http.StatusOK, jobs)
+}
+
+func (c *ControlServer) runJob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := c.runNamedJob(name); err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	writeControlJSON(w, http.StatusAccepted, map[string][]string{"started": {name}})
+}
+
+// runNamedJob runs a scheduled job immediately, in addition to its regular schedule
+func (c *ControlServer) runNamedJob(name string) error {
+	for _, j := range c.scheduler.Jobs() {
+		if j.Name() != name {
+			continue
+		}
+		if err := j.RunNow(); err != nil {
+			return err
+		}
+		log.Info().Msgf("Job %s triggered through the control API", name)
+		return nil
+	}
+	return errors.New("job " + name + " is not scheduled")
+}
+
+// selectTerminals returns the terminal given by the "terminal" query parameter, or all terminals
+func selectTerminals(r *http.Request) ([]*Terminal, error) {
+	if !r.URL.Query().Has("terminal") {
+		return terminals, nil
+	}
+	id := r.URL.Query().Get("terminal")
+	for _, t := range terminals {
+		if t.ID == id {
+			return []*Terminal{t}, nil
+		}
+	}
+	return nil, errors.New("unknown terminal " + id)
+}
+
+// runTerminalJobs runs a job of every selected terminal immediately
+func (c *ControlServer) runTerminalJobs(job string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selected, err := selectTerminals(r)
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+		started := make([]string, 0, len(selected))
+		for _, t := range selected {
+			if err := c.runNamedJob(t.name(job)); err != nil {
+				writeControlError(w, http.StatusNotFound, err)
+				return
+			}
+			started = append(started, t.name(job))
+		}
+		writeControlJSON(w, http.StatusAccepted, map[string][]string{"started": started})
+	}
+}
+
+type controlGateway struct {
+	Terminal  string `json:"terminal,omitempty"`
+	Gateway   string `json:"gateway"`
+	PoP       string `json:"pop"`
+	IPVersion int    `json:"ip_version"`
+}
+
+func (c *ControlServer) detectGateway(w http.ResponseWriter, r *http.Request) {
+	selected, err := selectTerminals(r)
+	if err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Info().Msg("Gateway re-detection triggered through the control API")
+	gateways := make([]controlGateway, 0, len(selected))
+	for _, t := range selected {
+		t.DetectGateway()
+		gateway, pop, ipVersion := t.Gateway()
+		gateways = append(gateways, controlGateway{
+			Terminal:  t.ID,
+			Gateway:   gateway,
+			PoP:       pop,
+			IPVersion: ipVersion,
+		})
+	}
+	writeControlJSON(w, http.StatusOK, gateways)
+}
+
+func (c *ControlServer) listSessions(w http.ResponseWriter, _ *http.Request) {
+	writeControlJSON(w, http.StatusOK, activeSessions.list())
+}
+
+// showConfig returns the effective configuration without credentials
+func (c *ControlServer) showConfig(w http.ResponseWriter, _ *http.Request) {
+	terminalConfigs := make([]map[string]any, 0, len(terminals))
+	for _, t := range terminals {
+		gateway, pop, ipVersion := t.Gateway()
+		terminalConfigs = append(terminalConfigs, map[string]any{
+			"id":             t.ID,
+			"iface":          t.Iface,
+			"active":         t.Active,
+			"manual_gateway": t.ManualGateway,
+			"dish_grpc":      t.dish.addr,
+			"router_grpc":    t.RouterGrpc,
+			"cron":           t.Cron,
+			"ping_targets":   t.PingTargets,
+			"gateway":        gateway,
+			"pop":            pop,
+			"ip_version":     ipVersion,
+		})
+	}
+
+	writeControlJSON(w, http.StatusOK, map[string]any{
+		"version":           version,
+		"client_name":       ClientName,
+		"terminals":         terminalConfigs,
+		"duration":          Duration,
+		"interval":          Interval,
+		"data_dir":          DataDir,
+		"ping_output":       PingFormats,
+		"enable_irtt":       EnableIRTT,
+		"irtt_host_port":    IRTTHostPort,
+		"enable_status":     EnableStatus,
+		"status_interval":   StatusInterval,
+		"enable_history":    EnableHistory,
+		"history_interval":  HistoryInterval,
+		"enable_outages":    EnableOutages,
+		"enable_location":   EnableLocation,
+		"location_interval": LocationInterval,
+		"events_interval":   EventsInterval,
+		"detect_interval":   DetectInterval,
+		"metrics_listen":    MetricsListen,
+		"upload_backend":    UploadBackend,
+	})
+}
+
+// StartControlServer serves the control API on a unix socket and/or a TCP address in the background
+func StartControlServer(scheduler gocron.Scheduler, socketPath, addr, token string) error {
+	c := &ControlServer{scheduler: scheduler, token: token}
+	handler := c.handler()
+
+	var listeners []net.Listener
+	if socketPath != "" {
+		// remove a stale socket left behind by a previous run
+		if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		l, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(socketPath, 0660); err != nil {
+			l.Close()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	for _, l := range listeners {
+		server := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Info().Msgf("Serving control API on %s", l.Addr())
+			if err := server.Serve(l); err != nil {
+				log.Error().Err(err).Msg("Control API server stopped")
+			}
+		}()
+	}
+	return nil
+}
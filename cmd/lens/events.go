@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// types of network events
+const (
+	eventPoP          = "pop"
+	eventGateway      = "gateway"
+	eventExternalIPv4 = "external_ipv4"
+	eventIPv6Prefix   = "ipv6_prefix"
+	// link and address events are reported by the LinkMonitor
+	eventLink    = "link"
+	eventAddress = "address"
+)
+
+// errNetworkChange is the cause of the cancellation of sessions that are ended by a network event
+var errNetworkChange = errors.New("network changed")
+
+// NetworkEvent is one line of an event-<datetime>.jsonl file
+type NetworkEvent struct {
+	Type     string `json:"type"`
+	Time     string `json:"time"`
+	Client   string `json:"client"`
+	Terminal string `json:"terminal,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	// FromCity and ToCity are set for PoP changes
+	FromCity string `json:"from_city,omitempty"`
+	ToCity   string `json:"to_city,omitempty"`
+}
+
+func (e *NetworkEvent) String() string {
+	switch {
+	case e.Type == eventPoP:
+		return fmt.Sprintf("%s changed from %s (%s) to %s (%s)", e.Type, e.From, e.FromCity, e.To, e.ToCity)
+	case e.From == "":
+		return fmt.Sprintf("%s %s added", e.Type, e.To)
+	case e.To == "":
+		return fmt.Sprintf("%s %s removed", e.Type, e.From)
+	}
+	return fmt.Sprintf("%s changed from %s to %s", e.Type, e.From, e.To)
+}
+
+func newNetworkEvent(typ, from, to string) NetworkEvent {
+	return NetworkEvent{
+		Type:   typ,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Client: ClientName,
+		From:   from,
+		To:     to,
+	}
+}
+
+// networkState is the last known PoP, gateway and external addresses of a terminal
+type networkState struct {
+	PoP          string
+	City         string
+	Gateway      string
+	ExternalIPv4 string
+	IPv6Prefix   string
+}
+
+// update records next as the known state and returns the changes from the previous one.
+// Values that are unknown in next, e.g. after a failed detection, keep their previous value,
+// and a value that becomes known for the first time is no change.
+func (s *networkState) update(next networkState) []NetworkEvent {
+	var events []NetworkEvent
+	changed := func(typ, from, to string) bool {
+		if from == "" || to == "" || from == to {
+			return false
+		}
+		events = append(events, newNetworkEvent(typ, from, to))
+		return true
+	}
+
+	if changed(eventPoP, s.PoP, next.PoP) {
+		events[len(events)-1].FromCity = s.City
+		events[len(events)-1].ToCity = next.City
+	}
+	changed(eventGateway, s.Gateway, next.Gateway)
+	changed(eventExternalIPv4, s.ExternalIPv4, next.ExternalIPv4)
+	changed(eventIPv6Prefix, s.IPv6Prefix, next.IPv6Prefix)
+
+	if next.PoP != "" {
+		s.PoP, s.City = next.PoP, next.City
+	}
+	if next.Gateway != "" {
+		s.Gateway = next.Gateway
+	}
+	if next.ExternalIPv4 != "" {
+		s.ExternalIPv4 = next.ExternalIPv4
+	}
+	if next.IPv6Prefix != "" {
+		s.IPv6Prefix = next.IPv6Prefix
+	}
+	return events
+}
+
+// delegatedPrefix returns the prefix Starlink delegates to the terminal of the external IPv6 address
+func delegatedPrefix(external net.IP) *net.IPNet {
+	mask := net.CIDRMask(starlinkDelegatedPrefixLen, 8*net.IPv6len)
+	return &net.IPNet{IP: external.Mask(mask), Mask: mask}
+}
+
+// networkStateLocked returns the current state of the terminal, t.mu must be held
+func (t *Terminal) networkStateLocked() networkState {
+	s := networkState{
+		PoP:          t.pop,
+		City:         t.city,
+		Gateway:      t.gateway,
+		ExternalIPv4: t.externalIPv4,
+	}
+	if ip := net.ParseIP(t.externalIPv6); ip != nil && ip.To4() == nil {
+		s.IPv6Prefix = delegatedPrefix(ip).String()
+	}
+	return s
+}
+
+// globalAddrs returns the global addresses of the interface of the terminal, sorted and comma separated
+func (t *Terminal) globalAddrs() string {
+	addrs, err := interfaceAddrs(t.Iface)
+	if err != nil {
+		log.Debug().Err(err).Msgf("Error getting addresses of %s", t.Iface)
+		return ""
+	}
+	var global []string
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			global = append(global, ipnet.String())
+		}
+	}
+	slices.Sort(global)
+	return strings.Join(global, ",")
+}
+
+// CheckNetwork runs every EVENTS_INTERVAL between the full detections of every EVENTS_DETECT_INTERVAL,
+// which look up the external addresses and trace the IPv6 gateway. It sends no probes: the gateway and PoP
+// are detected again only if the addresses of the interface changed since the last detection, e.g. when
+// EVENTS_NETLINK is disabled or a notification was lost. Otherwise the external address is looked up again
+// in the current GeoIP feed, as an update of the feed may move it to another PoP.
+func (t *Terminal) CheckNetwork() {
+	if t.linkDown() || !t.detecting.TryLock() {
+		// a detection is running, or follows when the link is up again
+		return
+	}
+	addrs := t.globalAddrs()
+	t.mu.Lock()
+	changed := addrs != "" && addrs != t.addrs
+	t.mu.Unlock()
+	t.detecting.Unlock()
+
+	if changed {
+		log.Info().Msgf("Addresses of %s changed, detecting the gateway%s", t.Iface, t.logSuffix())
+		t.DetectGateway()
+		return
+	}
+	t.lookupPoP()
+}
+
+// sessionContext returns the context of a new session, which is cancelled with errNetworkChange
+// when a network event ends the running sessions of the terminal
+func (t *Terminal) sessionContext() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions == nil {
+		t.sessions, t.endSessions = context.WithCancelCause(context.Background())
+	}
+	return t.sessions
+}
+
+// networkChanged reports whether the session of ctx was ended by a network event
+func networkChanged(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errNetworkChange)
+}
+
+// handleNetworkEvents records events, and ends the running sessions of the terminal,
+// which are restarted with the new PoP, gateway and addresses
+func (t *Terminal) handleNetworkEvents(events []NetworkEvent) {
+	if len(events) == 0 {
+		return
+	}
+	t.recordNetworkEvents(events)
+	if !RestartOnEvents {
+		return
+	}
+
+	summary := make([]string, 0, len(events))
+	for i := range events {
+		summary = append(summary, events[i].String())
+	}
+	t.endRunningSessions(fmt.Errorf("%w: %s", errNetworkChange, strings.Join(summary, ", ")))
+}
+
+// recordNetworkEvents logs, records and notifies events
+func (t *Terminal) recordNetworkEvents(events []NetworkEvent) {
+	for i := range events {
+		e := &events[i]
+		e.Terminal = t.ID
+
+		log.Warn().Msgf("Network event: %s%s", e, t.logSuffix())
+		if err := t.events.Write(e); err != nil {
+			log.Error().Err(err).Msg("Error recording network event")
+		}
+		observeNetworkEvent(t.ID, e.Type)
+		notifyEvent(e)
+	}
+}
+
+// endRunningSessions cancels the context of the running sessions of the terminal with cause
+func (t *Terminal) endRunningSessions(cause error) {
+	t.mu.Lock()
+	endSessions := t.endSessions
+	t.sessions, t.endSessions = nil, nil
+	t.mu.Unlock()
+	if endSessions != nil {
+		endSessions(cause)
+	}
+}
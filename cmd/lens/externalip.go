@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+
+	stunRetransmit = 500 * time.Millisecond
+)
+
+// sharedAddressSpace is the carrier grade NAT range of RFC 6598, which Starlink assigns behind its CGNAT
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// ExternalIP is the address a terminal is seen with on the Internet
+type ExternalIP struct {
+	Addr    net.IP
+	Version int
+	// Votes of the Answers of all providers agreed on Addr
+	Votes   int
+	Answers int
+	// Local is set when Addr is assigned to the interface, i.e. there is no NAT in front of it
+	Local bool
+	// CGNAT is set when the interface itself has an address in 100.64.0.0/10,
+	// i.e. it is directly behind the carrier grade NAT of Starlink
+	CGNAT bool
+	Time  time.Time
+}
+
+func (e *ExternalIP) String() string {
+	return e.Addr.String()
+}
+
+// ExternalIPResolver asks HTTP echo endpoints and STUN servers concurrently for the external address
+// of an interface, and accepts the address the majority of the answers agree on.
+// Results are cached per interface and IP version.
+type ExternalIPResolver struct {
+	HTTP     []string
+	STUN     []string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*ExternalIP
+}
+
+// externalIPs is replaced with the configured providers when the config is loaded
+var externalIPs = NewExternalIPResolver(nil, nil, 5*time.Second, 0)
+
+func NewExternalIPResolver(httpEndpoints, stunServers []string, timeout, cacheTTL time.Duration) *ExternalIPResolver {
+	return &ExternalIPResolver{
+		HTTP:     httpEndpoints,
+		STUN:     stunServers,
+		Timeout:  timeout,
+		CacheTTL: cacheTTL,
+		cache:    make(map[string]*ExternalIP),
+	}
+}
+
+// Lookup returns the external IPv4 or IPv6 address of iface
+func (r *ExternalIPResolver) Lookup(iface string, version int) (*ExternalIP, error) {
+	key := fmt.Sprintf("%s/%d", iface, version)
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Since(cached.Time) < r.CacheTTL {
+		return cached, nil
+	}
+
+	result, err := r.lookup(iface, version)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[key] = result
+	r.mu.Unlock()
+	return result, nil
+}
+
+// Invalidate drops the cached addresses of iface, e.g. after its addresses changed
+func (r *ExternalIPResolver) Invalidate(iface string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cache, iface+"/4")
+	delete(r.cache, iface+"/6")
+}
+
+func (r *ExternalIPResolver) lookup(iface string, version int) (*ExternalIP, error) {
+	unspecified := net.IPv6unspecified
+	if version == 4 {
+		unspecified = net.IPv4zero
+	}
+	source, err := interfaceSource(iface, unspecified)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	providers := len(r.HTTP) + len(r.STUN)
+	answers := make(chan net.IP, providers)
+	for _, endpoint := range r.HTTP {
+		go func() {
+			network := fmt.Sprintf("tcp%d", version)
+			ip, err := httpEchoLookup(ctx, bindDialer(iface, network, source), network, endpoint)
+			answers <- validAnswer(endpoint, version, ip, err)
+		}()
+	}
+	for _, server := range r.STUN {
+		go func() {
+			network := fmt.Sprintf("udp%d", version)
+			ip, err := stunLookup(ctx, bindDialer(iface, network, source), network, server)
+			answers <- validAnswer(server, version, ip, err)
+		}()
+	}
+
+	votes := make(map[string]int)
+	answered := 0
+	for range providers {
+		if ip := <-answers; ip != nil {
+			votes[ip.String()]++
+			answered++
+		}
+	}
+	if answered == 0 {
+		return nil, fmt.Errorf("no external IPv%d address provider answered on %s", version, iface)
+	}
+
+	addrs := make([]string, 0, len(votes))
+	for addr := range votes {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, func(a, b string) int {
+		return votes[b] - votes[a]
+	})
+	winner := addrs[0]
+	if votes[winner]*2 <= answered {
+		return nil, fmt.Errorf("external IPv%d address providers disagree on %s: %v", version, iface, votes)
+	}
+
+	result := &ExternalIP{
+		Addr:    net.ParseIP(winner),
+		Version: version,
+		Votes:   votes[winner],
+		Answers: answered,
+		CGNAT:   version == 4 && sharedAddressSpace.Contains(source),
+		Time:    time.Now(),
+	}
+	if addrs, err := interfaceAddrs(iface); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(result.Addr) {
+				result.Local = true
+			}
+		}
+	}
+	log.Debug().Msgf("External IPv%d address of %s: %s (%d of %d answers, local: %t, CGNAT: %t)",
+		version, iface, result.Addr, result.Votes, result.Answers, result.Local, result.CGNAT)
+	return result, nil
+}
+
+// validAnswer returns the address of a provider, or nil if it failed or answered with the wrong IP version
+func validAnswer(provider string, version int, ip net.IP, err error) net.IP {
+	if err != nil {
+		log.Debug().Err(err).Msgf("External IPv%d address provider %s failed", version, provider)
+		return nil
+	}
+	if (ip.To4() != nil) != (version == 4) {
+		log.Debug().Msgf("External IPv%d address provider %s answered %s", version, provider, ip)
+		return nil
+	}
+	return ip
+}
+
+// bindDialer binds connections of network to iface, or to its address source
+// when binding to the device is not permitted
+func bindDialer(iface, network string, source net.IP) *net.Dialer {
+	var local net.Addr
+	if !source.IsLinkLocalUnicast() {
+		if strings.HasPrefix(network, "udp") {
+			local = &net.UDPAddr{IP: source}
+		} else {
+			local = &net.TCPAddr{IP: source}
+		}
+	}
+	return &net.Dialer{
+		Control: func(network, _ string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = unix.BindToDevice(int(fd), iface)
+			}); err != nil {
+				return err
+			}
+			if bindErr != nil {
+				log.Debug().Err(bindErr).Msgf("Binding %s connection to %s by source address %s", network, iface, source)
+			}
+			return nil
+		},
+		LocalAddr: local,
+	}
+}
+
+// httpEchoLookup fetches an endpoint that answers with the address of the client in plain text
+func httpEchoLookup(ctx context.Context, dialer *net.Dialer, network, endpoint string) (net.IP, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("User-Agent", "starlink-lens/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s answered with an invalid address %q", endpoint, bytes.TrimSpace(body))
+	}
+	return ip, nil
+}
+
+// stunLookup sends a STUN binding request (RFC 5389) to server and returns the mapped address
+func stunLookup(ctx context.Context, dialer *net.Dialer, network, server string) (net.IP, error) {
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return nil, err
+	}
+	txID := request[8:20]
+
+	response := make([]byte, 1500)
+	for timeout := stunRetransmit; ctx.Err() == nil; timeout *= 2 {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(response)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if ip, ok := parseStunResponse(response[:n], txID); ok {
+				return ip, nil
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// parseStunResponse returns the XOR-MAPPED-ADDRESS, or the MAPPED-ADDRESS of old servers,
+// of a binding response to the request with txID
+func parseStunResponse(b, txID []byte) (net.IP, bool) {
+	if len(b) < stunHeaderSize ||
+		binary.BigEndian.Uint16(b[0:2]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(b[4:8]) != stunMagicCookie ||
+		!bytes.Equal(b[8:20], txID) {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	attrs := b[stunHeaderSize:min(stunHeaderSize+length, len(b))]
+
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+size {
+			break
+		}
+		value := attrs[4 : 4+size]
+		// attributes are padded to a multiple of 4 bytes
+		attrs = attrs[min(4+(size+3)&^3, len(attrs)):]
+
+		if size < 8 {
+			continue
+		}
+		var addr net.IP
+		switch value[1] {
+		case 0x01:
+			addr = slices.Clone(value[4:8])
+		case 0x02:
+			if size < 20 {
+				continue
+			}
+			addr = slices.Clone(value[4:20])
+		default:
+			continue
+		}
+
+		switch typ {
+		case stunAttrXorMappedAddress:
+			// the address is XORed with the magic cookie and, for IPv6, the transaction ID
+			key := b[4:20]
+			for i := range addr {
+				addr[i] ^= key[i]
+			}
+			return addr, true
+		case stunAttrMappedAddress:
+			mapped = addr
+		}
+	}
+	return mapped, mapped != nil
+}
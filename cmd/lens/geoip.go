@@ -1,97 +1,57 @@
 package main
 
 import (
-	"encoding/csv"
-	"io"
-	"net"
-	"net/http"
+	"context"
+	"errors"
+	"os"
 	"os/exec"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/clarkzjw/starlink-lens/pkg/geoip"
+	"github.com/phuslu/log"
 )
 
-type PopInfo struct {
-	CIDR string
-	Pop  string
-	City string
-}
+type PopInfo = geoip.PopInfo
 
+// GeoIPClient keeps the Starlink GeoIP feed up to date for the PoP lookups of the terminals
 type GeoIPClient struct {
-	mu sync.RWMutex
-
-	PopCsvLastUpdated int64
-
-	// map from cidr -> PopInfo
-	CIDRMap map[string]PopInfo
+	*geoip.Client
 }
 
-const (
-	popCsvURL = "https://geoip.starlinkisp.net/pops.csv"
-)
-
-// cidr,pop,city
-// 14.1.64.0/24,mnlaphl1,mnl
-// 14.1.65.0/24,mnlaphl1,mnl
-// 14.1.66.0/24,mnlaphl1,mnl
-// 14.1.67.0/24,mnlaphl1,mnl
-// 14.1.72.0/24,mlbeaus1,mel
-
-// fetchPoPCsv downloads and parses the POP CSV, returning the map on success.
-func fetchPoPCsv() (map[string]PopInfo, error) {
-	resp, err := http.Get(popCsvURL)
-	if err != nil {
-		return nil, err
+// NewGeoIPClient creates a GeoIPClient from the cached feed in cacheFile, or from seedFile
+// when there is no cache yet, and refreshes it from url unless offline is set.
+// Every distinct version of the feed is kept in snapshotDir.
+// If neither is available and the download fails, lookups find nothing until the next successful refresh.
+func NewGeoIPClient(url, cacheFile, seedFile, snapshotDir string, offline bool) *GeoIPClient {
+	client := &GeoIPClient{Client: geoip.NewClient(url)}
+	client.CacheFile = cacheFile
+	client.SnapshotDir = snapshotDir
+
+	if err := client.LoadCache(); err == nil {
+		log.Info().Msgf("Starlink GeoIP feed loaded from %s, %d prefixes", cacheFile, client.Table().Len())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warn().Err(err).Msgf("Error loading the cached Starlink GeoIP feed %s", cacheFile)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, err
-	}
-
-	r := csv.NewReader(resp.Body)
-	newMap := make(map[string]PopInfo)
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if len(record) < 3 {
-			continue
-		}
-		cidr := strings.TrimSpace(record[0])
-		pop := strings.TrimSpace(record[1])
-		city := strings.TrimSpace(record[2])
-		if cidr == "" {
-			continue
-		}
-		newMap[cidr] = PopInfo{
-			CIDR: cidr,
-			Pop:  pop,
-			City: city,
+	if client.Table() == nil && seedFile != "" {
+		if err := client.LoadFile(seedFile); err != nil {
+			log.Warn().Err(err).Msgf("Error loading the Starlink GeoIP feed %s", seedFile)
+		} else {
+			log.Info().Msgf("Starlink GeoIP feed loaded from %s, %d prefixes", seedFile, client.Table().Len())
 		}
 	}
-	return newMap, nil
-}
 
-// NewGeoIPClient creates a GeoIPClient, downloads the CSV from PopCsvUrl,
-// parses lines of the form cidr,pop,city and stores them in CIDRMap.
-// On success PopCsvLastUpdated is set to the current Unix timestamp.
-// On any error an empty client is returned (PopCsvLastUpdated == 0).
-func NewGeoIPClient() *GeoIPClient {
-	client := &GeoIPClient{
-		CIDRMap: make(map[string]PopInfo),
+	if offline {
+		if client.Table() == nil {
+			log.Warn().Msg("No Starlink GeoIP feed is available offline, PoPs are unknown")
+		}
+		return client
 	}
 
 	// attempt initial download once
-	if newMap, err := fetchPoPCsv(); err == nil {
-		client.mu.Lock()
-		client.CIDRMap = newMap
-		client.PopCsvLastUpdated = time.Now().Unix()
-		client.mu.Unlock()
+	client.refresh()
+	if client.Table() == nil {
+		log.Warn().Msg("Starlink GeoIP feed not available, PoPs are unknown until it can be downloaded")
 	}
 
 	go func(c *GeoIPClient) {
@@ -105,74 +65,35 @@ func NewGeoIPClient() *GeoIPClient {
 	return client
 }
 
-// UpdatePoPCsv check current time and compare with PopCsvLastUpdated, if more than 12 hours, re-download, and update PopCsvLastUpdated
-func (g *GeoIPClient) UpdatePoPCsv() {
-	if g == nil {
-		return
+func (g *GeoIPClient) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	changed, err := g.Refresh(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Error refreshing the Starlink GeoIP feed")
 	}
+	if changed {
+		log.Info().Msgf("Starlink GeoIP feed updated, %d prefixes", g.Table().Len())
+	}
+}
 
-	now := time.Now().Unix()
-
-	g.mu.RLock()
-	last := g.PopCsvLastUpdated
-	g.mu.RUnlock()
-
-	// if updated within 12 hours, nothing to do
-	if now-last < 3600 {
+// UpdatePoPCsv refreshes the feed when the last successful refresh is more than an hour ago
+func (g *GeoIPClient) UpdatePoPCsv() {
+	if g == nil {
 		return
 	}
-
-	newMap, err := fetchPoPCsv()
-	if err != nil {
+	if time.Since(g.Updated()) < time.Hour {
 		return
 	}
-
-	g.mu.Lock()
-	g.CIDRMap = newMap
-	g.PopCsvLastUpdated = time.Now().Unix()
-	g.mu.Unlock()
+	g.refresh()
 }
 
 // GetPopByCIDR returns the best-matching PopInfo for the given IP string
 func (g *GeoIPClient) GetPopByCIDR(cidr string) (PopInfo, bool) {
-	if g == nil || len(g.CIDRMap) == 0 {
+	if g == nil {
 		return PopInfo{}, false
 	}
-
-	parsedIP := net.ParseIP(cidr)
-	if parsedIP == nil {
-		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
-		if err != nil || ipnet == nil {
-			return PopInfo{}, false
-		}
-		parsedIP = ipnet.IP
-	}
-
-	// Choose the longest-prefix match when multiple CIDRs contain the IP.
-	bestOnes := -1
-	var best PopInfo
-
-	for cidr, info := range g.CIDRMap {
-		if info.City == "staging" {
-			continue
-		}
-		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
-		if err != nil || ipnet == nil {
-			continue
-		}
-		if ipnet.Contains(parsedIP) {
-			ones, _ := ipnet.Mask.Size()
-			if ones > bestOnes {
-				bestOnes = ones
-				best = info
-			}
-		}
-	}
-
-	if bestOnes >= 0 {
-		return best, true
-	}
-	return PopInfo{}, false
+	return g.Client.GetPopByCIDR(cidr)
 }
 
 // GetDNSPtrFromDig returns the PTR record for the given IP using dig command
@@ -8,10 +8,14 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
@@ -23,12 +27,37 @@ type Exporter struct {
 	Conn   *grpc.ClientConn
 	Client device.DeviceClient
 
-	DishID      string
-	CountryCode string
+	DishID          string
+	CountryCode     string
+	HardwareVersion string
+	SoftwareVersion string
 }
 
-func NewGrpcClient(address string) (*Exporter, error) {
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// NewGrpcClient connects to the gRPC API of a Starlink device.
+// If iface is set, the connection is bound to it, as dishes on different interfaces share the same address.
+func NewGrpcClient(address, iface string) (*Exporter, error) {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if iface != "" {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var bindErr error
+			dialer := net.Dialer{
+				Control: func(_, _ string, c syscall.RawConn) error {
+					if err := c.Control(func(fd uintptr) {
+						bindErr = unix.BindToDevice(int(fd), iface)
+					}); err != nil {
+						return err
+					}
+					if bindErr != nil {
+						return fmt.Errorf("error binding gRPC connection to %s: %w", iface, os.NewSyscallError("setsockopt", bindErr))
+					}
+					return nil
+				},
+			}
+			return dialer.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.NewClient(address, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("connect to Starlink dish gRPC interface failed: %s", err.Error())
 	}
@@ -56,13 +85,56 @@ func NewGrpcClient(address string) (*Exporter, error) {
 	}
 
 	return &Exporter{
-		Conn:        conn,
-		Client:      client,
-		DishID:      deviceInfo.GetId(),
-		CountryCode: deviceInfo.GetCountryCode(),
+		Conn:            conn,
+		Client:          client,
+		DishID:          deviceInfo.GetId(),
+		CountryCode:     deviceInfo.GetCountryCode(),
+		HardwareVersion: deviceInfo.GetHardwareVersion(),
+		SoftwareVersion: deviceInfo.GetSoftwareVersion(),
 	}, nil
 }
 
+// DishClient lazily connects to the gRPC API of a Starlink device
+// and reconnects on the next use after Reset is called.
+type DishClient struct {
+	addr  string
+	iface string
+
+	mu       sync.Mutex
+	exporter *Exporter
+}
+
+func NewDishClient(addr, iface string) *DishClient {
+	return &DishClient{addr: addr, iface: iface}
+}
+
+// Get returns the connected client, connecting first if necessary
+func (d *DishClient) Get() (*Exporter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.exporter != nil {
+		return d.exporter, nil
+	}
+	exporter, err := NewGrpcClient(d.addr, d.iface)
+	if err != nil {
+		return nil, err
+	}
+	d.exporter = exporter
+	return exporter, nil
+}
+
+// Reset drops the current connection, e.g. after a failed request
+func (d *DishClient) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.exporter != nil {
+		d.exporter.Conn.Close()
+		d.exporter = nil
+	}
+}
+
 // StarlinkGetObstructionMapResponse represents the obstruction map data
 type StarlinkGetObstructionMapResponse struct {
 	Timestamp         string
@@ -177,3 +249,60 @@ func (e *Exporter) WriteObstructionMapImage(filename string) error {
 	}
 	return nil
 }
+
+func (e *Exporter) CollectDishStatus() (*device.DishGetStatusResponse, error) {
+	req := &device.Request{
+		Request: &device.Request_GetStatus{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	resp, err := e.Client.Handle(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC GetStatus failed: %w", err)
+	}
+
+	status := resp.GetDishGetStatus()
+	if status == nil {
+		return nil, errors.New("gRPC GetStatus failed: dishGetStatus is nil")
+	}
+	return status, nil
+}
+
+func (e *Exporter) CollectDishHistory() (*device.DishGetHistoryResponse, error) {
+	req := &device.Request{
+		Request: &device.Request_GetHistory{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	resp, err := e.Client.Handle(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC GetHistory failed: %w", err)
+	}
+
+	history := resp.GetDishGetHistory()
+	if history == nil {
+		return nil, errors.New("gRPC GetHistory failed: dishGetHistory is nil")
+	}
+	return history, nil
+}
+
+func (e *Exporter) CollectLocation() (*device.GetLocationResponse, error) {
+	req := &device.Request{
+		Request: &device.Request_GetLocation{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	resp, err := e.Client.Handle(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC GetLocation failed: %w", err)
+	}
+
+	location := resp.GetGetLocation()
+	if location == nil || location.GetLla() == nil {
+		return nil, errors.New("gRPC GetLocation failed: lla is nil")
+	}
+	return location, nil
+}
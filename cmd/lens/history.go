@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/clarkzjw/starlink-grpc-golang/pkg/spacex.com/api/device"
+	"github.com/phuslu/log"
+)
+
+const (
+	historyStateName = "history-state"
+
+	// a new boot time within this tolerance is considered the same boot,
+	// as uptime and the local clock are sampled at slightly different moments
+	historyBootTolerance = 30 * time.Second
+)
+
+// HistorySample is one per-second sample taken from the dish history ring buffers.
+// Counter is the dish's monotonically increasing sample index within a boot.
+type HistorySample struct {
+	Type                  string   `json:"type"`
+	Timestamp             int64    `json:"timestamp"`
+	Counter               uint64   `json:"counter"`
+	PopPingDropRate       *float32 `json:"pop_ping_drop_rate,omitempty"`
+	PopPingLatencyMs      *float32 `json:"pop_ping_latency_ms,omitempty"`
+	DownlinkThroughputBps *float32 `json:"downlink_throughput_bps,omitempty"`
+	UplinkThroughputBps   *float32 `json:"uplink_throughput_bps,omitempty"`
+	PowerIn               *float32 `json:"power_in,omitempty"`
+}
+
+// HistoryGap marks samples that could not be harvested, either because the
+// dish rebooted ("reboot") or because polling fell more than a ring buffer behind ("overrun").
+type HistoryGap struct {
+	Type        string `json:"type"`
+	Reason      string `json:"reason"`
+	Timestamp   int64  `json:"timestamp"`
+	FromCounter uint64 `json:"from_counter"`
+	ToCounter   uint64 `json:"to_counter"`
+	Missing     uint64 `json:"missing,omitempty"`
+}
+
+// HistoryEvent is one entry of the dish event log
+type HistoryEvent struct {
+	Type             string `json:"type"`
+	Severity         string `json:"severity"`
+	Reason           string `json:"reason"`
+	StartTimestampNs int64  `json:"start_timestamp_ns"`
+	DurationNs       uint64 `json:"duration_ns"`
+}
+
+// historyState is persisted so that harvesting continues without duplicates across restarts
+type historyState struct {
+	DishID         string `json:"dish_id"`
+	BootTime       int64  `json:"boot_time"`
+	Current        uint64 `json:"current"`
+	LastEventNs    int64  `json:"last_event_ns"`
+	LastHarvest    int64  `json:"last_harvest"`
+	HarvestedTotal uint64 `json:"harvested_total"`
+}
+
+// HistoryHarvester periodically reads the dish GetHistory ring buffers and
+// appends every sample that is new since the last poll to history-<datetime>.jsonl
+type HistoryHarvester struct {
+	terminal  *Terminal
+	dish      *DishClient
+	recorder  *Recorder
+	statePath string
+
+	mu    sync.Mutex
+	state *historyState
+}
+
+func NewHistoryHarvester(t *Terminal) *HistoryHarvester {
+	h := &HistoryHarvester{
+		terminal: t,
+		dish:     t.dish,
+		recorder: NewRecorder("history", t, time.Hour),
+		// each terminal keeps its own state, e.g. <DataDir>/history-state-dish1.json
+		statePath: path.Join(DataDir, t.name(historyStateName)+".json"),
+	}
+	state, err := loadHistoryState(h.statePath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Error loading history harvester state, starting from scratch%s", t.logSuffix())
+	}
+	h.state = state
+	return h
+}
+
+func loadHistoryState(filename string) (*historyState, error) {
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state historyState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	return &state, nil
+}
+
+func (s *historyState) save(filename string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Harvest polls GetHistory once and records the samples added since the previous poll
+func (h *HistoryHarvester) Harvest() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	exporter, err := h.dish.Get()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating gRPC client to Starlink dish")
+		return
+	}
+
+	status, err := exporter.CollectDishStatus()
+	if err != nil {
+		log.Error().Err(err).Msg("Error collecting dish status for history harvesting")
+		h.dish.Reset()
+		return
+	}
+	history, err := exporter.CollectDishHistory()
+	if err != nil {
+		log.Error().Err(err).Msg("Error collecting dish history")
+		h.dish.Reset()
+		return
+	}
+	now := time.Now()
+	h.terminal.outages.ObserveStatus(status)
+	h.terminal.outages.ObserveHistory(history)
+
+	bootTime := now.Unix() - int64(status.GetDeviceState().GetUptimeS())
+	if err := h.harvest(history, exporter.DishID, bootTime, now); err != nil {
+		log.Error().Err(err).Msg("Error recording dish history")
+		return
+	}
+	if err := h.state.save(h.statePath); err != nil {
+		log.Error().Err(err).Msg("Error saving history harvester state")
+	}
+}
+
+func (h *HistoryHarvester) harvest(history *device.DishGetHistoryResponse, dishID string, bootTime int64, now time.Time) error {
+	current := history.GetCurrent()
+	bufLen := uint64(len(history.GetPopPingLatencyMs()))
+	if bufLen == 0 {
+		return errors.New("dish history ring buffer is empty")
+	}
+
+	// the oldest sample still held in the ring buffer
+	oldest := uint64(0)
+	if current > bufLen {
+		oldest = current - bufLen
+	}
+	from := oldest
+
+	prev := h.state
+	switch {
+	case prev == nil || prev.DishID != dishID:
+		log.Info().Msgf("Starting history harvesting for dish %s at sample %d", dishID, current)
+	case current < prev.Current || absInt64(bootTime-prev.BootTime) > int64(historyBootTolerance.Seconds()):
+		// samples between the previous poll and the reboot are lost
+		log.Warn().Msgf("Dish rebooted since last history poll, counter %d -> %d", prev.Current, current)
+		if err := h.recorder.Write(&HistoryGap{
+			Type:        "gap",
+			Reason:      "reboot",
+			Timestamp:   bootTime,
+			FromCounter: prev.Current,
+			ToCounter:   from,
+		}); err != nil {
+			return err
+		}
+	case prev.Current < oldest:
+		missing := oldest - prev.Current
+		log.Warn().Msgf("History polling fell behind, %d samples lost", missing)
+		if err := h.recorder.Write(&HistoryGap{
+			Type:        "gap",
+			Reason:      "overrun",
+			Timestamp:   now.Unix() - int64(current-prev.Current),
+			FromCounter: prev.Current,
+			ToCounter:   oldest,
+			Missing:     missing,
+		}); err != nil {
+			return err
+		}
+	default:
+		from = prev.Current
+	}
+
+	for c := from; c < current; c++ {
+		idx := int(c % bufLen)
+		if err := h.recorder.Write(&HistorySample{
+			Type: "sample",
+			// the sample at current-1 covers the last full second
+			Timestamp:             now.Unix() - int64(current-c),
+			Counter:               c,
+			PopPingDropRate:       ringValue(history.GetPopPingDropRate(), idx),
+			PopPingLatencyMs:      ringValue(history.GetPopPingLatencyMs(), idx),
+			DownlinkThroughputBps: ringValue(history.GetDownlinkThroughputBps(), idx),
+			UplinkThroughputBps:   ringValue(history.GetUplinkThroughputBps(), idx),
+			PowerIn:               ringValue(history.GetPowerIn(), idx),
+		}); err != nil {
+			return err
+		}
+	}
+
+	lastEventNs := int64(0)
+	harvested := uint64(0)
+	if prev != nil && prev.DishID == dishID {
+		lastEventNs = prev.LastEventNs
+		harvested = prev.HarvestedTotal
+	}
+	for _, e := range history.GetEventLog().GetEvents() {
+		if e.GetStartTimestampNs() <= lastEventNs {
+			continue
+		}
+		if err := h.recorder.Write(&HistoryEvent{
+			Type:             "event",
+			Severity:         e.GetSeverity().String(),
+			Reason:           e.GetReason().String(),
+			StartTimestampNs: e.GetStartTimestampNs(),
+			DurationNs:       e.GetDurationNs(),
+		}); err != nil {
+			return err
+		}
+		lastEventNs = max(lastEventNs, e.GetStartTimestampNs())
+	}
+
+	log.Debug().Msgf("Harvested %d history samples (%d -> %d)", current-from, from, current)
+	h.state = &historyState{
+		DishID:         dishID,
+		BootTime:       bootTime,
+		Current:        current,
+		LastEventNs:    lastEventNs,
+		LastHarvest:    now.Unix(),
+		HarvestedTotal: harvested + current - from,
+	}
+	return nil
+}
+
+func ringValue(buf []float32, idx int) *float32 {
+	if idx >= len(buf) {
+		return nil
+	}
+	v := buf[idx]
+	return &v
+}
+
+func absInt64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
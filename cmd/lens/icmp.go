@@ -0,0 +1,762 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+
+	defaultPayloadSize = 56
+
+	// a send is repeated when it failed with the pending ICMP error of an earlier probe
+	icmpSendAttempts = 3
+)
+
+type ProbeStatus string
+
+const (
+	ProbeReply       ProbeStatus = "reply"
+	ProbeTimeout     ProbeStatus = "timeout"
+	ProbeDuplicate   ProbeStatus = "dup"
+	ProbeUnreachable ProbeStatus = "unreachable"
+)
+
+// ProbeResult is the outcome of a single ICMP echo request.
+// Seq is the session-wide sequence number starting at 1,
+// while the on-wire ICMP sequence wraps at 65535 like ping does.
+type ProbeResult struct {
+	Seq      int
+	Sent     time.Time
+	Received time.Time
+	RTT      time.Duration
+	TTL      int
+	Size     int
+	From     string
+	Status   ProbeStatus
+}
+
+// WireSeq returns the 16-bit ICMP sequence number as seen on the wire
+func (r *ProbeResult) WireSeq() int {
+	return r.Seq & 0xffff
+}
+
+// ProbeStats summarizes a probing session the same way ping does in its footer
+type ProbeStats struct {
+	Transmitted int
+	Received    int
+	Duplicates  int
+	Errors      int
+	Start       time.Time
+	End         time.Time
+
+	rttMin   time.Duration
+	rttMax   time.Duration
+	rttSum   float64
+	rttSumSq float64
+}
+
+func (s *ProbeStats) add(r *ProbeResult) {
+	switch r.Status {
+	case ProbeReply:
+		s.Received++
+		if s.Received == 1 || r.RTT < s.rttMin {
+			s.rttMin = r.RTT
+		}
+		if r.RTT > s.rttMax {
+			s.rttMax = r.RTT
+		}
+		ms := float64(r.RTT.Microseconds()) / 1000.0
+		s.rttSum += ms
+		s.rttSumSq += ms * ms
+	case ProbeDuplicate:
+		s.Duplicates++
+	case ProbeUnreachable:
+		s.Errors++
+	case ProbeTimeout:
+	}
+}
+
+// Loss returns the packet loss in percent
+func (s *ProbeStats) Loss() float64 {
+	if s.Transmitted == 0 {
+		return 0
+	}
+	return float64(s.Transmitted-s.Received) * 100.0 / float64(s.Transmitted)
+}
+
+// RTT returns min/avg/max/mdev of the received replies in milliseconds
+func (s *ProbeStats) RTT() (minMs, avgMs, maxMs, mdevMs float64) {
+	if s.Received == 0 {
+		return 0, 0, 0, 0
+	}
+	avgMs = s.rttSum / float64(s.Received)
+	mdevMs = math.Sqrt(math.Max(s.rttSumSq/float64(s.Received)-avgMs*avgMs, 0))
+	return float64(s.rttMin.Microseconds()) / 1000.0, avgMs, float64(s.rttMax.Microseconds()) / 1000.0, mdevMs
+}
+
+type pendingProbe struct {
+	seq      int
+	sent     time.Time
+	replied  bool
+	deadline time.Time
+}
+
+// ICMPProber sends ICMP or ICMPv6 echo requests to Target from Iface.
+// It prefers unprivileged datagram sockets and falls back to raw sockets.
+// Replies are timestamped by the kernel (SO_TIMESTAMPNS) like ping -D does. Datagram sockets only
+// receive the ICMP errors of their probes on the error queue (IP_RECVERR), raw sockets receive them as messages.
+type ICMPProber struct {
+	Iface       string
+	Target      net.IP
+	Interval    time.Duration
+	Count       int
+	Timeout     time.Duration
+	PayloadSize int
+
+	Source net.IP
+
+	version int
+	raw     bool
+	id      int
+	conn    net.PacketConn
+	rc      syscall.RawConn
+	dst     net.Addr
+
+	mu      sync.Mutex
+	pending map[int]*pendingProbe
+}
+
+func NewICMPProber(iface string, ip net.IP) (*ICMPProber, error) {
+	p := &ICMPProber{
+		Iface:       iface,
+		Target:      ip,
+		Interval:    time.Second,
+		Timeout:     probeTimeout,
+		PayloadSize: defaultPayloadSize,
+		version:     6,
+		pending:     make(map[int]*pendingProbe),
+	}
+	if ip.To4() != nil {
+		p.version = 4
+	}
+
+	src, err := interfaceSource(iface, ip)
+	if err != nil {
+		return nil, err
+	}
+	p.Source = src
+
+	if err := p.listen(); err != nil {
+		return nil, err
+	}
+
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		p.conn.Close()
+		return nil, fmt.Errorf("error generating ICMP identifier: %w", err)
+	}
+	p.id = int(binary.BigEndian.Uint16(idBuf[:]))
+
+	return p, nil
+}
+
+// interfaceSource returns an address on iface in the same family as target,
+// preferring link-local addresses only when the target itself is link-local.
+func interfaceSource(iface string, target net.IP) (net.IP, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("error getting interface %s: %w", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting addresses of interface %s: %w", iface, err)
+	}
+
+	wantV4 := target.To4() != nil
+	version := 6
+	if wantV4 {
+		version = 4
+	}
+	var fallback net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() != nil) != wantV4 {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() == target.IsLinkLocalUnicast() {
+			return ipnet.IP, nil
+		}
+		if fallback == nil {
+			fallback = ipnet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no IPv%d address on interface %s", version, iface)
+	}
+	return fallback, nil
+}
+
+func (p *ICMPProber) listen() error {
+	var err error
+	if p.conn, err = p.listenDatagram(); err != nil {
+		log.Debug().Err(err).Msg("Unprivileged ICMP socket unavailable, falling back to raw socket")
+		if p.conn, err = p.listenRaw(); err != nil {
+			return fmt.Errorf("error opening ICMP socket on %s: %w", p.Iface, err)
+		}
+		p.raw = true
+	}
+
+	sc, ok := p.conn.(syscall.Conn)
+	if !ok {
+		p.conn.Close()
+		return fmt.Errorf("unsupported ICMP socket %T", p.conn)
+	}
+	if p.rc, err = sc.SyscallConn(); err != nil {
+		p.conn.Close()
+		return fmt.Errorf("error getting ICMP socket on %s: %w", p.Iface, err)
+	}
+	p.setsockopts()
+
+	zone := ""
+	if p.Target.IsLinkLocalUnicast() {
+		zone = p.Iface
+	}
+	if p.raw {
+		p.dst = &net.IPAddr{IP: p.Target, Zone: zone}
+	} else {
+		p.dst = &net.UDPAddr{IP: p.Target, Zone: zone}
+	}
+	return nil
+}
+
+func (p *ICMPProber) sockopts() (level, recverr, recvttl, ttl int) {
+	if p.version == 4 {
+		return unix.IPPROTO_IP, unix.IP_RECVERR, unix.IP_RECVTTL, unix.IP_TTL
+	}
+	return unix.IPPROTO_IPV6, unix.IPV6_RECVERR, unix.IPV6_RECVHOPLIMIT, unix.IPV6_HOPLIMIT
+}
+
+// setsockopts enables the control messages with the receive time and the TTL of replies, and the error queue
+// of datagram sockets. Without them, replies are timestamped when they are read, and errors are reported as loss.
+func (p *ICMPProber) setsockopts() {
+	level, recverr, recvttl, _ := p.sockopts()
+	err := p.rc.Control(func(fd uintptr) {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+			log.Warn().Err(err).Msg("Error enabling kernel timestamps of ICMP replies")
+		}
+		if err := unix.SetsockoptInt(int(fd), level, recvttl, 1); err != nil {
+			log.Debug().Err(err).Msg("Error enabling TTL control messages")
+		}
+		if p.raw {
+			return
+		}
+		if err := unix.SetsockoptInt(int(fd), level, recverr, 1); err != nil {
+			log.Warn().Err(err).Msg("Error enabling the ICMP error queue, unreachable probes are reported as lost")
+		}
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error setting ICMP socket options")
+	}
+}
+
+// listenDatagram opens a non-privileged ping socket (net.ipv4.ping_group_range) bound to Iface
+func (p *ICMPProber) listenDatagram() (net.PacketConn, error) {
+	family, proto := unix.AF_INET, protocolICMP
+	var sa unix.Sockaddr = &unix.SockaddrInet4{}
+	if p.version == 6 {
+		family, proto = unix.AF_INET6, protocolIPv6ICMP
+		sa = &unix.SockaddrInet6{}
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := p.bindToDevice(fd); err != nil {
+		// SO_BINDTODEVICE needs CAP_NET_RAW before Linux 5.7, pin the source address instead
+		log.Debug().Err(err).Msgf("Binding ping socket to %s by source address %s", p.Iface, p.Source)
+		if p.version == 4 {
+			sa4 := &unix.SockaddrInet4{}
+			copy(sa4.Addr[:], p.Source.To4())
+			sa = sa4
+		} else {
+			sa6 := &unix.SockaddrInet6{}
+			copy(sa6.Addr[:], p.Source.To16())
+			if ifi, err := net.InterfaceByName(p.Iface); err == nil && p.Source.IsLinkLocalUnicast() {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+			sa = sa6
+		}
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp-"+p.Iface)
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// listenRaw opens a raw ICMP socket bound to Iface, which requires CAP_NET_RAW
+func (p *ICMPProber) listenRaw() (net.PacketConn, error) {
+	network := "ip4:icmp"
+	if p.version == 6 {
+		network = "ip6:ipv6-icmp"
+	}
+
+	var bindErr error
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			if err := c.Control(func(fd uintptr) {
+				bindErr = p.bindToDevice(int(fd))
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	return lc.ListenPacket(context.Background(), network, "")
+}
+
+func (p *ICMPProber) bindToDevice(fd int) error {
+	if p.Iface == "" {
+		return nil
+	}
+	if err := unix.BindToDevice(fd, p.Iface); err != nil {
+		return fmt.Errorf("error binding ICMP socket to %s: %w", p.Iface, os.NewSyscallError("setsockopt", err))
+	}
+	return nil
+}
+
+func (p *ICMPProber) Close() error {
+	return p.conn.Close()
+}
+
+// Privileged reports whether the prober had to fall back to a raw socket
+func (p *ICMPProber) Privileged() bool {
+	return p.raw
+}
+
+func (p *ICMPProber) echoRequest(seq int) ([]byte, error) {
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if p.version == 6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{
+			ID:   p.id,
+			Seq:  seq & 0xffff,
+			Data: make([]byte, p.PayloadSize),
+		},
+	}
+	return msg.Marshal(nil)
+}
+
+// recv reads the next ICMP message, or the next ICMP error from the error queue of a datagram socket,
+// which holds the echo request the error quotes. The read deadline of the connection applies.
+func (p *ICMPProber) recv(b, oob []byte) (n, oobn int, from unix.Sockaddr, errQueue bool, err error) {
+	readErr := p.rc.Read(func(fd uintptr) bool {
+		for {
+			if !p.raw {
+				n, oobn, _, from, err = unix.Recvmsg(int(fd), b, oob, unix.MSG_ERRQUEUE)
+				if err == nil {
+					errQueue = true
+					return true
+				}
+			}
+			n, oobn, _, from, err = unix.Recvmsg(int(fd), b, oob, 0)
+			// the error of an ICMP error that was queued is also reported once by the next read
+			if p.raw || !isICMPErrno(err) {
+				return !errors.Is(err, unix.EAGAIN)
+			}
+		}
+	})
+	if readErr != nil {
+		return 0, 0, nil, false, readErr
+	}
+	if err != nil {
+		return 0, 0, nil, false, os.NewSyscallError("recvmsg", err)
+	}
+	if p.raw && p.version == 4 && n > 0 {
+		// raw IPv4 sockets receive the IP header
+		hdrLen := int(b[0]&0x0f) << 2
+		if hdrLen > n {
+			return 0, 0, nil, false, errors.New("truncated IPv4 header")
+		}
+		n = copy(b, b[hdrLen:n])
+	}
+	return n, oobn, from, errQueue, nil
+}
+
+// icmpControl is what the control messages of a received ICMP message tell
+type icmpControl struct {
+	received time.Time
+	ttl      int
+	// offender and unreachable are set for an ICMP error from the error queue
+	offender    net.IP
+	unreachable bool
+}
+
+func (p *ICMPProber) parseControl(oob []byte) icmpControl {
+	var c icmpControl
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return c
+	}
+	level, recverr, _, ttl := p.sockopts()
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS:
+			c.received, _ = parseTimespec(m.Data)
+		case int(m.Header.Level) == level && int(m.Header.Type) == ttl && len(m.Data) >= 4:
+			c.ttl = int(int32(binary.NativeEndian.Uint32(m.Data)))
+		case int(m.Header.Level) == level && int(m.Header.Type) == recverr && len(m.Data) >= sizeofEEHeader+8:
+			// struct sock_extended_err followed by the address of the router that sent the error
+			origin, typ := m.Data[4], m.Data[5]
+			offender := m.Data[sizeofEEHeader:]
+			switch {
+			case origin == unix.SO_EE_ORIGIN_ICMP && binary.NativeEndian.Uint16(offender) == unix.AF_INET:
+				c.offender = net.IP(offender[4:8])
+				c.unreachable = typ == icmpUnreachable
+			case origin == unix.SO_EE_ORIGIN_ICMP6 && binary.NativeEndian.Uint16(offender) == unix.AF_INET6 && len(offender) >= 24:
+				c.offender = net.IP(offender[8:24])
+				c.unreachable = typ == icmpv6Unreachable
+			}
+		}
+	}
+	return c
+}
+
+// parseTimespec parses the struct timespec of SCM_TIMESTAMPNS, whose fields are longs
+func parseTimespec(b []byte) (time.Time, bool) {
+	switch {
+	case unix.SizeofLong == 8 && len(b) >= 16:
+		return time.Unix(int64(binary.NativeEndian.Uint64(b[0:8])), int64(binary.NativeEndian.Uint64(b[8:16]))), true
+	case unix.SizeofLong == 4 && len(b) >= 8:
+		return time.Unix(int64(int32(binary.NativeEndian.Uint32(b[0:4]))), int64(binary.NativeEndian.Uint32(b[4:8]))), true
+	}
+	return time.Time{}, false
+}
+
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:])
+	}
+	return nil
+}
+
+func (p *ICMPProber) writeTo(b []byte) error {
+	var err error
+	for range icmpSendAttempts {
+		_, err = p.conn.WriteTo(b, p.dst)
+		// like a read, a send first reports the error of an ICMP error that was queued, and fails without sending
+		if p.raw || !isICMPErrno(err) {
+			break
+		}
+	}
+	return err
+}
+
+// Run sends Count echo requests (or until ctx is done when Count <= 0) every Interval
+// and calls handle once per probe outcome from a single goroutine.
+// Replies may be reported out of sequence order, timeouts are reported once Timeout has elapsed.
+func (p *ICMPProber) Run(ctx context.Context, handle func(ProbeResult)) (ProbeStats, error) {
+	stats := ProbeStats{Start: time.Now()}
+	results := make(chan ProbeResult, 1024)
+
+	var wg sync.WaitGroup
+	recvCtx, stopRecv := context.WithCancel(context.Background())
+	defer stopRecv()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.receive(recvCtx, results)
+	}()
+
+	sendDone := make(chan error, 1)
+	go func() {
+		sendDone <- p.send(ctx, &stats)
+	}()
+
+	sweep := time.NewTicker(min(p.Timeout/4, 100*time.Millisecond))
+	defer sweep.Stop()
+
+	var sendErr error
+	sending := true
+	var lingerUntil time.Time
+	for {
+		select {
+		case r := <-results:
+			stats.add(&r)
+			handle(r)
+			continue
+		case sendErr = <-sendDone:
+			sending = false
+			lingerUntil = time.Now().Add(p.Timeout)
+		case now := <-sweep.C:
+			for _, r := range p.expire(now, false) {
+				stats.add(&r)
+				handle(r)
+			}
+		}
+
+		if !sending && (p.inflight() == 0 || time.Now().After(lingerUntil)) {
+			break
+		}
+	}
+
+	stopRecv()
+	wg.Wait()
+	close(results)
+	for r := range results {
+		stats.add(&r)
+		handle(r)
+	}
+	for _, r := range p.expire(time.Now(), true) {
+		stats.add(&r)
+		handle(r)
+	}
+
+	stats.End = time.Now()
+	return stats, sendErr
+}
+
+func (p *ICMPProber) send(ctx context.Context, stats *ProbeStats) error {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for seq := 1; p.Count <= 0 || seq <= p.Count; seq++ {
+		b, err := p.echoRequest(seq)
+		if err != nil {
+			return fmt.Errorf("error marshalling ICMP echo request: %w", err)
+		}
+
+		// the probe is pending before it is sent, as its reply may be read before the send returns
+		now := time.Now()
+		p.mu.Lock()
+		p.pending[seq&0xffff] = &pendingProbe{seq: seq, sent: now, deadline: now.Add(p.Timeout)}
+		p.mu.Unlock()
+
+		if err := p.writeTo(b); err != nil {
+			// ping keeps going on transient send errors such as ENOBUFS or a link flap,
+			// a probe that was not sent is neither transmitted nor lost
+			log.Debug().Err(err).Msgf("Error sending ICMP echo request icmp_seq=%d", seq&0xffff)
+			p.mu.Lock()
+			delete(p.pending, seq&0xffff)
+			p.mu.Unlock()
+		} else {
+			stats.Transmitted++
+		}
+
+		if p.Count > 0 && seq == p.Count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (p *ICMPProber) receive(ctx context.Context, results chan<- ProbeResult) {
+	proto := protocolICMP
+	if p.version == 6 {
+		proto = protocolIPv6ICMP
+	}
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+
+	for ctx.Err() == nil {
+		if err := p.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			log.Error().Err(err).Msg("Error setting ICMP read deadline")
+			return
+		}
+		n, oobn, src, errQueue, err := p.recv(buf, oob)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if ctx.Err() == nil {
+				log.Debug().Err(err).Msg("Error reading ICMP reply")
+			}
+			continue
+		}
+		cm := p.parseControl(oob[:oobn])
+		if cm.received.IsZero() {
+			cm.received = time.Now()
+		}
+
+		var r ProbeResult
+		var ok bool
+		if errQueue {
+			r, ok = p.matchError(buf[:n], &cm)
+		} else {
+			msg, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil {
+				continue
+			}
+			r, ok = p.match(msg, sockaddrIP(src), &cm, n)
+		}
+		if ok {
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// match pairs an incoming ICMP message with an outstanding probe
+func (p *ICMPProber) match(msg *icmp.Message, from net.IP, cm *icmpControl, size int) (ProbeResult, bool) {
+	var wireSeq int
+	status := ProbeReply
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+			return ProbeResult{}, false
+		}
+		// datagram sockets get the identifier rewritten by the kernel, which also demultiplexes replies for us
+		if p.raw && body.ID != p.id {
+			return ProbeResult{}, false
+		}
+		if !from.Equal(p.Target) {
+			return ProbeResult{}, false
+		}
+		wireSeq = body.Seq
+	case *icmp.DstUnreach:
+		seq, ok := p.quotedSeq(body.Data)
+		if !ok {
+			return ProbeResult{}, false
+		}
+		wireSeq = seq
+		status = ProbeUnreachable
+	default:
+		return ProbeResult{}, false
+	}
+	return p.pair(wireSeq, status, from, cm, size)
+}
+
+// matchError pairs an ICMP error from the error queue with the echo request it quotes
+func (p *ICMPProber) matchError(echo []byte, cm *icmpControl) (ProbeResult, bool) {
+	if !cm.unreachable || len(echo) < 8 {
+		return ProbeResult{}, false
+	}
+	wireSeq := int(binary.BigEndian.Uint16(echo[6:8]))
+	return p.pair(wireSeq, ProbeUnreachable, cm.offender, cm, len(echo))
+}
+
+// pair completes the outstanding probe with the wire sequence number of a reply or error
+func (p *ICMPProber) pair(wireSeq int, status ProbeStatus, from net.IP, cm *icmpControl, size int) (ProbeResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp, ok := p.pending[wireSeq]
+	if !ok {
+		return ProbeResult{}, false
+	}
+
+	r := ProbeResult{
+		Seq:      pp.seq,
+		Sent:     pp.sent,
+		Received: cm.received,
+		RTT:      cm.received.Sub(pp.sent),
+		TTL:      cm.ttl,
+		Size:     size,
+		From:     from.String(),
+		Status:   status,
+	}
+	if status == ProbeUnreachable {
+		delete(p.pending, wireSeq)
+		return r, true
+	}
+	if pp.replied {
+		r.Status = ProbeDuplicate
+		return r, true
+	}
+	pp.replied = true
+	// keep the entry around until its deadline so that duplicates can be detected
+	return r, true
+}
+
+// quotedSeq extracts the echo sequence number from the original datagram quoted in an ICMP error
+func (p *ICMPProber) quotedSeq(data []byte) (int, bool) {
+	hdrLen := ipv6.HeaderLen
+	if p.version == 4 {
+		if len(data) < ipv4.HeaderLen {
+			return 0, false
+		}
+		hdrLen = int(data[0]&0x0f) << 2
+	}
+	if len(data) < hdrLen+8 {
+		return 0, false
+	}
+	echo := data[hdrLen:]
+	if p.raw && int(binary.BigEndian.Uint16(echo[4:6])) != p.id {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(echo[6:8])), true
+}
+
+// expire reports probes whose deadline passed without any reply, or all unanswered probes when flush is set
+func (p *ICMPProber) expire(now time.Time, flush bool) []ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var expired []ProbeResult
+	for k, pp := range p.pending {
+		if !flush && now.Before(pp.deadline) {
+			continue
+		}
+		delete(p.pending, k)
+		if pp.replied {
+			continue
+		}
+		expired = append(expired, ProbeResult{
+			Seq:    pp.seq,
+			Sent:   pp.sent,
+			Status: ProbeTimeout,
+		})
+	}
+	return expired
+}
+
+// inflight returns the number of probes that are still waiting for a reply
+func (p *ICMPProber) inflight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, pp := range p.pending {
+		if !pp.replied {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/phuslu/log"
+)
+
+// location access is retried this long after the dish refused it
+const locationRetryAfter = time.Hour
+
+// LocationFix is one line of a location-<datetime>.jsonl track file
+type LocationFix struct {
+	Timestamp          string  `json:"timestamp"`
+	Lat                float64 `json:"lat"`
+	Lon                float64 `json:"lon"`
+	Alt                float64 `json:"alt"`
+	SigmaM             float64 `json:"sigma_m"`
+	Source             string  `json:"source"`
+	HorizontalSpeedMps float64 `json:"horizontal_speed_mps"`
+	VerticalSpeedMps   float64 `json:"vertical_speed_mps"`
+}
+
+// LocationTracker polls the dish GetLocation API and keeps a daily track.
+// Location access must be allowed for the local network in the Starlink app,
+// otherwise the dish answers with PermissionDenied and the tracker backs off.
+type LocationTracker struct {
+	dish     *DishClient
+	recorder *Recorder
+
+	mu            sync.Mutex
+	last          *LocationFix
+	disabledUntil time.Time
+}
+
+func NewLocationTracker(t *Terminal) *LocationTracker {
+	l := &LocationTracker{
+		dish:     t.dish,
+		recorder: NewRecorder("location", t, 24*time.Hour),
+	}
+	l.recorder.onRotate = exportTrackFiles
+	return l
+}
+
+// Collect polls GetLocation once and appends the fix to the daily track
+func (t *LocationTracker) Collect() {
+	fix := t.Fix()
+	if fix == nil {
+		return
+	}
+	if err := t.recorder.Write(fix); err != nil {
+		log.Error().Err(err).Msg("Error recording dish location")
+	}
+}
+
+// Last returns the most recent fix without polling the dish, or nil before the first fix
+func (t *LocationTracker) Last() *LocationFix {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		return nil
+	}
+	fix := *t.last
+	return &fix
+}
+
+// Prefetch collects a fix when there is none yet, so that sessions started
+// before the first poll of the collector are located
+func (t *LocationTracker) Prefetch() {
+	if t != nil && t.Last() == nil {
+		t.Collect()
+	}
+}
+
+// Fix polls the current position of the dish.
+// It returns nil when the tracker is disabled or location access is not available.
+func (t *LocationTracker) Fix() *LocationFix {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	disabled := time.Now().Before(t.disabledUntil)
+	t.mu.Unlock()
+	if disabled {
+		return nil
+	}
+
+	exporter, err := t.dish.Get()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating gRPC client to Starlink dish")
+		return nil
+	}
+	location, err := exporter.CollectLocation()
+	if err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			log.Warn().Msgf("Location access is disabled on the dish, enable it in the Starlink app to track location, retrying in %s", locationRetryAfter)
+			t.mu.Lock()
+			t.disabledUntil = time.Now().Add(locationRetryAfter)
+			t.mu.Unlock()
+			return nil
+		}
+		log.Error().Err(err).Msg("Error collecting dish location")
+		t.dish.Reset()
+		return nil
+	}
+
+	fix := LocationFix{
+		Timestamp:          time.Now().UTC().Format(time.RFC3339Nano),
+		Lat:                location.GetLla().GetLat(),
+		Lon:                location.GetLla().GetLon(),
+		Alt:                location.GetLla().GetAlt(),
+		SigmaM:             location.GetSigmaM(),
+		Source:             location.GetSource().String(),
+		HorizontalSpeedMps: location.GetHorizontalSpeedMps(),
+		VerticalSpeedMps:   location.GetVerticalSpeedMps(),
+	}
+	t.mu.Lock()
+	last := fix
+	t.last = &last
+	t.mu.Unlock()
+	return &fix
+}
+
+// readTrack reads the fixes of a location-<datetime>.jsonl file
+func readTrack(r io.Reader) ([]LocationFix, error) {
+	var track []LocationFix
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var fix LocationFix
+		if err := json.Unmarshal([]byte(line), &fix); err != nil {
+			return nil, fmt.Errorf("error parsing location fix: %w", err)
+		}
+		track = append(track, fix)
+	}
+	return track, scanner.Err()
+}
+
+type gpxTrackPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  float64 `xml:"ele"`
+	Time string  `xml:"time"`
+}
+
+type gpxDocument struct {
+	XMLName xml.Name `xml:"gpx"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   struct {
+		Name    string `xml:"name"`
+		Segment struct {
+			Points []gpxTrackPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// writeGPX writes the track as a GPX 1.1 document with a single track segment
+func writeGPX(w io.Writer, name string, track []LocationFix) error {
+	doc := gpxDocument{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "starlink-lens",
+	}
+	doc.Track.Name = name
+	for _, fix := range track {
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxTrackPoint{
+			Lat:  fix.Lat,
+			Lon:  fix.Lon,
+			Ele:  fix.Alt,
+			Time: fix.Timestamp,
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeGeoJSON writes the track as a FeatureCollection with one LineString,
+// with the timestamp and accuracy of each point in the coordTimes and sigmaM properties
+func writeGeoJSON(w io.Writer, name string, track []LocationFix) error {
+	coordinates := make([][3]float64, 0, len(track))
+	times := make([]string, 0, len(track))
+	sigmas := make([]float64, 0, len(track))
+	for _, fix := range track {
+		coordinates = append(coordinates, [3]float64{fix.Lon, fix.Lat, fix.Alt})
+		times = append(times, fix.Timestamp)
+		sigmas = append(sigmas, fix.SigmaM)
+	}
+
+	doc := map[string]any{
+		"type": "FeatureCollection",
+		"features": []any{
+			map[string]any{
+				"type": "Feature",
+				"geometry": map[string]any{
+					"type":        "LineString",
+					"coordinates": coordinates,
+				},
+				"properties": map[string]any{
+					"name":       name,
+					"coordTimes": times,
+					"sigmaM":     sigmas,
+				},
+			},
+		},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// exportTrackFiles writes <track>.gpx and <track>.geojson next to a finished track file
+func exportTrackFiles(directory, filename string) []string {
+	f, err := os.Open(path.Join(directory, filename))
+	if err != nil {
+		log.Error().Err(err).Msgf("Error opening location track %s", filename)
+		return nil
+	}
+	defer f.Close()
+
+	track, err := readTrack(f)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error reading location track %s", filename)
+		return nil
+	}
+	if len(track) == 0 {
+		return nil
+	}
+
+	base := strings.TrimSuffix(filename, ".jsonl")
+	var exported []string
+	for ext, write := range map[string]func(io.Writer, string, []LocationFix) error{
+		"gpx":     writeGPX,
+		"geojson": writeGeoJSON,
+	} {
+		name := fmt.Sprintf("%s.%s", base, ext)
+		out, err := os.Create(path.Join(directory, name))
+		if err != nil {
+			log.Error().Err(err).Msgf("Error creating %s", name)
+			continue
+		}
+		err = write(out, base, track)
+		out.Close()
+		if err != nil {
+			log.Error().Err(err).Msgf("Error writing %s", name)
+			continue
+		}
+		exported = append(exported, name)
+	}
+	return exported
+}
@@ -3,29 +3,42 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/phuslu/log"
 )
 
+// version is set at build time by goreleaser
+var version = "dev"
+
 var (
 	getObstructionMap *bool
+	configFile        *string
 	geoipClient       *GeoIPClient
 )
 
-func init() {
+// setup parses the flags, runs a command if one is given, and loads the config
+func setup() {
 	log.DefaultLogger.SetLevel(log.InfoLevel)
 
 	log.Info().Msg("Starlink LENS")
 	getObstructionMap = flag.Bool("map", false, "Get obstruction map")
+	configFile = flag.String("config", defaultConfigFile, "Path to the config file")
 
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	if *getObstructionMap {
-		if DishGrpcAddrPort == "" {
-			DishGrpcAddrPort = defaultDishGRPCAddress
+		// the obstruction map is taken from the first terminal
+		dish := NewDishClient(defaultDishGRPCAddress, "")
+		if c, err := readConfig(*configFile); err == nil {
+			dish = NewTerminal(c.terminals()[0]).dish
 		}
-		grpcClient, err := NewGrpcClient(DishGrpcAddrPort)
+		grpcClient, err := dish.Get()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error creating gRPC client")
 		}
@@ -36,9 +49,7 @@ func init() {
 		return
 	}
 
-	geoipClient = NewGeoIPClient()
-
-	if err := LoadConfig(); err != nil {
+	if err := LoadConfig(*configFile); err != nil {
 		log.Fatal().Err(err).Msg("Error loading config")
 	}
 
@@ -48,17 +59,13 @@ func init() {
 }
 
 func main() {
-	if Iface == "" {
-		log.Fatal().Msg("IFACE is not set")
-	}
+	setup()
 
-	log.Info().Msgf("Starlink Gateway: %s", StarlinkGateway)
 	log.Info().Msgf("DURATION: %s", Duration)
 	log.Info().Msgf("INTERVAL: %s", Interval)
-	log.Info().Msgf("INTERVAL_SEC: %.2f", IntervalSeconds)
-	log.Info().Msgf("IFACE: %s", Iface)
-	log.Info().Msgf("COUNT: %d", Count)
-	log.Info().Msgf("PoP: %s", PoP)
+	for _, t := range terminals {
+		t.logConfig()
+	}
 
 	s, err := gocron.NewScheduler()
 	if err != nil {
@@ -70,52 +77,50 @@ func main() {
 		}
 	}()
 
-	_, err = s.NewJob(
-		gocron.CronJob(
-			"30 * * * *",
-			false,
-		),
-		gocron.NewTask(
-			getGateway,
-		),
-	)
-	if err != nil {
-		log.Error().Err(err).Msg("Error creating getGateway job")
-		return
+	for _, t := range terminals {
+		if err := t.schedule(s); err != nil {
+			log.Error().Err(err).Msgf("Error scheduling jobs%s", t.logSuffix())
+			return
+		}
 	}
 
-	_, err = s.NewJob(
-		gocron.CronJob(
-			CronString,
-			false,
-		),
-		gocron.NewTask(
-			ICMPPing,
-			StarlinkGateway,
-			IntervalSeconds,
-		),
-	)
-	if err != nil {
-		log.Error().Err(err).Msg("Error creating icmp_ping job")
-		return
+	if WatchLinks {
+		if _, err := StartLinkMonitor(terminals); err != nil {
+			log.Error().Err(err).Msg("Error following link changes, changes are detected every EVENTS_INTERVAL")
+		}
 	}
 
-	if EnableIRTT {
+	// files left open when lens was stopped, e.g. of recorders that rarely write
+	finalizeRecorders()
+
+	if spool != nil {
 		_, err = s.NewJob(
-			gocron.CronJob(
-				CronString,
-				false,
+			gocron.DurationJob(
+				spoolFlushEvery,
 			),
 			gocron.NewTask(
-				IRTTPing,
+				spool.Flush,
 			),
+			gocron.WithName("upload_spool"),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+			gocron.WithStartAt(gocron.WithStartImmediately()),
 		)
 		if err != nil {
-			log.Error().Err(err).Msg("Error creating irtt_ping job")
+			log.Error().Err(err).Msg("Error creating upload_spool job")
 			return
 		}
 	}
 
+	if MetricsListen != "" {
+		StartMetricsServer(MetricsListen, !EnableStatus)
+	}
+
+	if ControlSocket != "" || ControlListen != "" {
+		if err := StartControlServer(s, ControlSocket, ControlListen, ControlToken); err != nil {
+			log.Fatal().Err(err).Msg("Error starting control API")
+		}
+	}
+
 	s.Start()
 
 	for _, j := range s.Jobs() {
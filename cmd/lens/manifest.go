@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// ManifestEntry describes one result file
+type ManifestEntry struct {
+	Key     string       `json:"key"`
+	File    string       `json:"file"`
+	Kind    string       `json:"kind"`
+	Size    int64        `json:"size"`
+	SHA256  string       `json:"sha256"`
+	Added   string       `json:"added"`
+	Session *SessionMeta `json:"session,omitempty"`
+	// Uploaded is the time the upload of the file was verified, after which the local file is removed
+	Uploaded string `json:"uploaded,omitempty"`
+}
+
+// Manifest lists all result files of a client that were finished on one day (UTC).
+// It is kept in <DataDir>/manifests while the day is running, and uploaded as
+// <ClientName>/manifest/<year>/<month>/<date>/manifest-<date>.json once the day is over
+// and all its files were uploaded, so that the uploaded manifest records the upload of every file.
+type Manifest struct {
+	Client string          `json:"client"`
+	Date   string          `json:"date"`
+	Files  []ManifestEntry `json:"files"`
+}
+
+// ManifestStore keeps the manifests that were not queued for upload yet in memory,
+// and writes every change to their files in dir.
+type ManifestStore struct {
+	mu  sync.Mutex
+	dir string
+	// days are the manifests by date
+	days map[string]*Manifest
+	// index is the date of the manifest of every file whose upload was not recorded yet, by key
+	index map[string]string
+}
+
+// manifests records every result file, nil before the config is loaded
+var manifests *ManifestStore
+
+// NewManifestStore creates the manifest directory and loads the manifests left in it by a previous run
+func NewManifestStore(dir string) (*ManifestStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating manifest directory %s: %w", dir, err)
+	}
+	s := &ManifestStore{
+		dir:   dir,
+		days:  make(map[string]*Manifest),
+		index: make(map[string]string),
+	}
+
+	filenames, err := filepath.Glob(path.Join(dir, manifestFilename("*")))
+	if err != nil {
+		return nil, fmt.Errorf("error listing manifests in %s: %w", dir, err)
+	}
+	for _, filename := range filenames {
+		m, err := readManifestFile(filename)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error reading manifest %s", filename)
+			continue
+		}
+		s.load(m)
+	}
+	return s, nil
+}
+
+func manifestFilename(date string) string {
+	return "manifest-" + date + ".json"
+}
+
+func manifestKey(date string) string {
+	return path.Join(ClientName, "manifest", date[:4], date[5:7], date, manifestFilename(date))
+}
+
+func fileSHA256(filename string) (int64, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if _, err := time.Parse(time.DateOnly, m.Date); err != nil {
+		return nil, fmt.Errorf("invalid manifest date %q", m.Date)
+	}
+	return &m, nil
+}
+
+func readManifestFile(filename string) (*Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readManifest(f)
+}
+
+// Add records a result file in the manifest of today, before it is uploaded as key
+func (s *ManifestStore) Add(kind, localFilename, key string, session *SessionMeta) error {
+	size, sum, err := fileSHA256(localFilename)
+	if err != nil {
+		return fmt.Errorf("error hashing %s: %w", localFilename, err)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format(time.DateOnly)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := path.Join(s.dir, manifestFilename(date))
+	m, ok := s.days[date]
+	if !ok {
+		// the day rolled over, the manifests of the days before may be complete
+		s.finalize(date)
+
+		m, err = readManifestFile(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			m = &Manifest{Client: ClientName, Date: date}
+		} else if err != nil {
+			return err
+		}
+		s.load(m)
+	}
+	m.Files = append(m.Files, ManifestEntry{
+		Key:     key,
+		File:    localFilename,
+		Kind:    kind,
+		Size:    size,
+		SHA256:  sum,
+		Added:   now.Format(time.RFC3339),
+		Session: session,
+	})
+	s.index[key] = date
+	if err := writeFileAtomic(filename, m); err != nil {
+		return fmt.Errorf("error writing manifest %s: %w", filename, err)
+	}
+	return nil
+}
+
+// MarkUploaded records that the upload of the file of key was verified
+func (s *ManifestStore) MarkUploaded(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	date, ok := s.index[key]
+	if !ok {
+		// e.g. a manifest, or a file left in the spool by an earlier version
+		return nil
+	}
+	delete(s.index, key)
+	m := s.days[date]
+	i := slices.IndexFunc(m.Files, func(e ManifestEntry) bool {
+		return e.Key == key && e.Uploaded == ""
+	})
+	if i < 0 {
+		return nil
+	}
+	m.Files[i].Uploaded = time.Now().UTC().Format(time.RFC3339)
+	filename := path.Join(s.dir, manifestFilename(date))
+	if err := writeFileAtomic(filename, m); err != nil {
+		return fmt.Errorf("error writing manifest %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Finalize queues the manifests of the days before today for upload, it is called after every flush of the spool
+func (s *ManifestStore) Finalize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finalize(time.Now().UTC().Format(time.DateOnly))
+}
+
+// finalize queues the manifests of the days before today for upload once the files of their day were uploaded,
+// and removes them from memory. Without an upload backend, they are kept in the manifest directory.
+func (s *ManifestStore) finalize(today string) {
+	for date, m := range s.days {
+		if date >= today {
+			continue
+		}
+		if spool != nil {
+			// the manifest waits for the files of its day that are still queued
+			if slices.ContainsFunc(m.Files, func(e ManifestEntry) bool { return e.Uploaded == "" && spool.Pending(e.Key) }) {
+				continue
+			}
+			filename := path.Join(s.dir, manifestFilename(date))
+			if err := spool.Enqueue(filename, manifestKey(date)); err != nil {
+				log.Error().Err(err).Msgf("Error queueing manifest %s for upload", filename)
+				continue
+			}
+		}
+		for _, e := range m.Files {
+			if s.index[e.Key] == date {
+				delete(s.index, e.Key)
+			}
+		}
+		delete(s.days, date)
+	}
+}
+
+// load adds a manifest to the manifests in memory
+func (s *ManifestStore) load(m *Manifest) {
+	s.days[m.Date] = m
+	for _, e := range m.Files {
+		if e.Uploaded == "" {
+			s.index[e.Key] = m.Date
+		}
+	}
+}
+
+// writeFileAtomic writes v as JSON to a temporary file and renames it to filename
+func writeFileAtomic(filename string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// RemoteStore is implemented by upload backends whose objects can be read back
+type RemoteStore interface {
+	// List returns the size of all objects whose key starts with prefix
+	List(ctx context.Context, prefix string) (map[string]int64, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// VerifyReport lists the problems found in the files of one manifest
+type VerifyReport struct {
+	Manifest string
+	Files    int
+	// Uploaded counts the files that were uploaded and removed locally, which are not verified locally
+	Uploaded  int
+	Missing   []string
+	Corrupted []string
+	Orphaned  []string
+}
+
+func (r *VerifyReport) ok() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0 && len(r.Orphaned) == 0
+}
+
+// verifyLocal checks the files of a manifest that were not uploaded yet in dataDir and in the upload spool,
+// and reports compressed files in the directory of the same day that are not in listed,
+// the files of all manifests, as files finished at midnight are recorded on the next day
+func verifyLocal(m *Manifest, name, dataDir, spoolDir string, listed map[string]bool) *VerifyReport {
+	r := &VerifyReport{Manifest: name, Files: len(m.Files)}
+	for _, e := range m.Files {
+		if e.Uploaded != "" {
+			r.Uploaded++
+			continue
+		}
+		candidates := []string{e.File, path.Join(spoolDir, e.Key)}
+
+		found := false
+		for _, filename := range candidates {
+			size, sum, err := fileSHA256(filename)
+			if err != nil {
+				continue
+			}
+			found = true
+			if size != e.Size || sum != e.SHA256 {
+				r.Corrupted = append(r.Corrupted, filename)
+			}
+			break
+		}
+		if !found {
+			r.Missing = append(r.Missing, e.File)
+		}
+	}
+
+	filenames, err := filepath.Glob(path.Join(dataDir, m.Date, "*"))
+	if err != nil {
+		log.Error().Err(err).Msgf("Error listing the files of %s", m.Date)
+	}
+	for _, filename := range filenames {
+		if isCompressed(filename) && !listed[path.Clean(filename)] {
+			r.Orphaned = append(r.Orphaned, filename)
+		}
+	}
+	return r
+}
+
+func isCompressed(filename string) bool {
+	return strings.HasSuffix(filename, ".zst") || strings.HasSuffix(filename, ".gz")
+}
+
+// verifyRemote checks the objects of a manifest in the object store, and reports the objects
+// of the same day that are not in the manifest. objects are all objects of the client.
+// The content is only downloaded and hashed when checksum is set, otherwise only sizes are compared.
+func verifyRemote(ctx context.Context, store RemoteStore, objects map[string]int64, m *Manifest, name string, checksum bool) *VerifyReport {
+	r := &VerifyReport{Manifest: name, Files: len(m.Files)}
+	listed := map[string]bool{manifestKey(m.Date): true}
+	for _, e := range m.Files {
+		listed[e.Key] = true
+		size, ok := objects[e.Key]
+		switch {
+		case !ok:
+			r.Missing = append(r.Missing, e.Key)
+		case size != e.Size:
+			r.Corrupted = append(r.Corrupted, e.Key)
+		case checksum:
+			sum, err := remoteSHA256(ctx, store, e.Key)
+			if err != nil || sum != e.SHA256 {
+				r.Corrupted = append(r.Corrupted, e.Key)
+			}
+		}
+	}
+
+	// keys are <client>/<kind>/<year>/<month>/<date>/<file>
+	for key := range objects {
+		parts := strings.Split(key, "/")
+		if len(parts) == 6 && parts[4] == m.Date && !listed[key] {
+			r.Orphaned = append(r.Orphaned, key)
+		}
+	}
+	slices.Sort(r.Orphaned)
+	return r
+}
+
+func remoteSHA256(ctx context.Context, store RemoteStore, key string) (string, error) {
+	body, err := store.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
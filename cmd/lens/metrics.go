@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clarkzjw/starlink-grpc-golang/pkg/spacex.com/api/device"
+	"github.com/phuslu/log"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type metricType string
+
+const (
+	gaugeMetric   metricType = "gauge"
+	counterMetric metricType = "counter"
+)
+
+type metricFamily struct {
+	name   string
+	help   string
+	typ    metricType
+	values map[string]float64
+}
+
+// Metrics is a minimal registry that renders the Prometheus text exposition format
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+func (m *Metrics) register(name, help string, typ metricType) {
+	m.families[name] = &metricFamily{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		values: make(map[string]float64),
+	}
+}
+
+// labelString renders label pairs ("k1", "v1", "k2", "v2") as {k1="v1",k2="v2"}
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Set sets a gauge, labels are given as name/value pairs
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.families[name]; ok {
+		f.values[labelString(labels)] = value
+	}
+}
+
+// Add increments a counter, labels are given as name/value pairs
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.families[name]; ok {
+		f.values[labelString(labels)] += delta
+	}
+}
+
+// Reset removes the series of a metric whose first labels match the given name/value pairs,
+// or all series without labels, e.g. before setting an info metric with new labels
+func (m *Metrics) Reset(name string, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		return
+	}
+	if len(labels) == 0 {
+		clear(f.values)
+		return
+	}
+	match := labelString(labels)
+	prefix := strings.TrimSuffix(match, "}") + ","
+	for series := range f.values {
+		if series == match || strings.HasPrefix(series, prefix) {
+			delete(f.values, series)
+		}
+	}
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		f := m.families[name]
+		if len(f.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		series := make([]string, 0, len(f.values))
+		for labels := range f.values {
+			series = append(series, labels)
+		}
+		slices.Sort(series)
+		for _, labels := range series {
+			fmt.Fprintf(&sb, "%s%s %s\n", f.name, labels, strconv.FormatFloat(f.values[labels], 'g', -1, 64))
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+var metrics = newLensMetrics()
+
+func newLensMetrics() *Metrics {
+	m := NewMetrics()
+	m.register("lens_info", "Version and client name of this lens instance.", gaugeMetric)
+	m.register("lens_gateway_info", "Currently detected Starlink gateway, PoP and IP version.", gaugeMetric)
+	m.register("lens_ip_version", "IP version used for measurements.", gaugeMetric)
+	m.register("lens_gateway_detection_timestamp_seconds", "Time of the last gateway detection.", gaugeMetric)
+	m.register("lens_link_up", "Whether the link of the interface of a terminal is up.", gaugeMetric)
+	m.register("lens_network_events_total", "Network events: changes of PoP, gateway, external addresses, link and interface addresses.", counterMetric)
+	m.register("lens_sessions_total", "Measurement sessions run.", counterMetric)
+	m.register("lens_sessions_failed_total", "Measurement sessions that failed or produced no results.", counterMetric)
+	m.register("lens_last_session_success", "Whether the last session of a kind succeeded.", gaugeMetric)
+	m.register("lens_last_session_timestamp_seconds", "End time of the last session of a kind.", gaugeMetric)
+	m.register("lens_last_session_loss_percent", "Packet loss of the last ping session.", gaugeMetric)
+	m.register("lens_last_session_rtt_avg_ms", "Average RTT of the last ping session.", gaugeMetric)
+	m.register("lens_uploads_total", "Uploads to the object store by result.", counterMetric)
+	m.register("lens_upload_bytes_total", "Bytes uploaded to the object store.", counterMetric)
+	m.register("lens_upload_spool_files", "Files waiting in the upload spool.", gaugeMetric)
+	m.register("lens_upload_spool_bytes", "Bytes waiting in the upload spool.", gaugeMetric)
+	m.register("lens_dish_up", "Whether the dish gRPC API answered the last GetStatus request.", gaugeMetric)
+	m.register("lens_dish_info", "Dish ID, hardware and software version.", gaugeMetric)
+	m.register("lens_dish_uptime_seconds", "Dish uptime.", gaugeMetric)
+	m.register("lens_dish_pop_ping_latency_ms", "PoP ping latency reported by the dish.", gaugeMetric)
+	m.register("lens_dish_pop_ping_drop_rate", "PoP ping drop rate reported by the dish.", gaugeMetric)
+	m.register("lens_dish_downlink_throughput_bps", "Downlink throughput reported by the dish.", gaugeMetric)
+	m.register("lens_dish_uplink_throughput_bps", "Uplink throughput reported by the dish.", gaugeMetric)
+	m.register("lens_dish_fraction_obstructed", "Fraction of the sky obstructed.", gaugeMetric)
+	m.register("lens_dish_currently_obstructed", "Whether the dish is currently obstructed.", gaugeMetric)
+	m.register("lens_dish_boresight_azimuth_deg", "Boresight azimuth.", gaugeMetric)
+	m.register("lens_dish_boresight_elevation_deg", "Boresight elevation.", gaugeMetric)
+	m.register("lens_dish_outage", "Whether the dish currently reports an outage, by cause.", gaugeMetric)
+	m.register("lens_dish_alert", "Active dish alerts.", gaugeMetric)
+	return m
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// observeSession updates the session counters after a session of the given kind ended
+func observeSession(terminal, kind string, ok bool) {
+	metrics.Add("lens_sessions_total", 1, "terminal", terminal, "kind", kind)
+	if !ok {
+		metrics.Add("lens_sessions_failed_total", 1, "terminal", terminal, "kind", kind)
+	}
+	metrics.Set("lens_last_session_success", boolFloat(ok), "terminal", terminal, "kind", kind)
+	metrics.Set("lens_last_session_timestamp_seconds", float64(time.Now().Unix()), "terminal", terminal, "kind", kind)
+}
+
+// observeGateway exports the result of the last gateway detection
+func observeGateway(terminal, gateway, pop string, ipVersion int) {
+	metrics.Reset("lens_gateway_info", "terminal", terminal)
+	metrics.Set("lens_gateway_info", 1, "terminal", terminal, "gateway", gateway, "pop", pop, "ip_version", strconv.Itoa(ipVersion))
+	metrics.Set("lens_ip_version", float64(ipVersion), "terminal", terminal)
+	metrics.Set("lens_gateway_detection_timestamp_seconds", float64(time.Now().Unix()), "terminal", terminal)
+}
+
+// observeNetworkEvent counts a network event of the given type
+func observeNetworkEvent(terminal, typ string) {
+	metrics.Add("lens_network_events_total", 1, "terminal", terminal, "type", typ)
+}
+
+// observeDishStatus exports live fields of a GetStatus response
+func observeDishStatus(terminal string, status *device.DishGetStatusResponse) {
+	t := []string{"terminal", terminal}
+	metrics.Set("lens_dish_up", 1, t...)
+	info := status.GetDeviceInfo()
+	metrics.Reset("lens_dish_info", t...)
+	metrics.Set("lens_dish_info", 1,
+		"terminal", terminal,
+		"id", info.GetId(),
+		"hardware_version", info.GetHardwareVersion(),
+		"software_version", info.GetSoftwareVersion())
+	metrics.Set("lens_dish_uptime_seconds", float64(status.GetDeviceState().GetUptimeS()), t...)
+	metrics.Set("lens_dish_pop_ping_latency_ms", float64(status.GetPopPingLatencyMs()), t...)
+	metrics.Set("lens_dish_pop_ping_drop_rate", float64(status.GetPopPingDropRate()), t...)
+	metrics.Set("lens_dish_downlink_throughput_bps", float64(status.GetDownlinkThroughputBps()), t...)
+	metrics.Set("lens_dish_uplink_throughput_bps", float64(status.GetUplinkThroughputBps()), t...)
+	metrics.Set("lens_dish_fraction_obstructed", float64(status.GetObstructionStats().GetFractionObstructed()), t...)
+	metrics.Set("lens_dish_currently_obstructed", boolFloat(status.GetObstructionStats().GetCurrentlyObstructed()), t...)
+	metrics.Set("lens_dish_boresight_azimuth_deg", float64(status.GetBoresightAzimuthDeg()), t...)
+	metrics.Set("lens_dish_boresight_elevation_deg", float64(status.GetBoresightElevationDeg()), t...)
+
+	metrics.Reset("lens_dish_outage", t...)
+	if o := status.GetOutage(); o != nil && o.GetStartTimestampNs() != 0 {
+		metrics.Set("lens_dish_outage", 1, "terminal", terminal, "cause", o.GetCause().String())
+	}
+
+	metrics.Reset("lens_dish_alert", t...)
+	alerts := status.GetAlerts().ProtoReflect()
+	fields := alerts.Descriptor().Fields()
+	for i := range fields.Len() {
+		fd := fields.Get(i)
+		if alerts.Has(fd) && fd.Kind() == protoreflect.BoolKind && alerts.Get(fd).Bool() {
+			metrics.Set("lens_dish_alert", 1, "terminal", terminal, "alert", string(fd.Name()))
+		}
+	}
+}
+
+// MetricsServer serves /metrics. When no status collector is running,
+// the dishes are polled on every scrape so that their status is still live.
+type MetricsServer struct {
+	pollOnRead bool
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if s.pollOnRead {
+		var wg sync.WaitGroup
+		for _, t := range terminals {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pollDish(t)
+			}()
+		}
+		wg.Wait()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := metrics.WriteTo(w); err != nil {
+		log.Debug().Err(err).Msg("Error writing metrics response")
+	}
+}
+
+func pollDish(t *Terminal) {
+	exporter, err := t.dish.Get()
+	if err != nil {
+		metrics.Set("lens_dish_up", 0, "terminal", t.ID)
+		return
+	}
+	status, err := exporter.CollectDishStatus()
+	if err != nil {
+		metrics.Set("lens_dish_up", 0, "terminal", t.ID)
+		t.dish.Reset()
+		return
+	}
+	observeDishStatus(t.ID, status)
+}
+
+// StartMetricsServer listens on addr in the background
+func StartMetricsServer(addr string, pollOnRead bool) {
+	metrics.Set("lens_info", 1, "version", version, "client", ClientName)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &MetricsServer{pollOnRead: pollOnRead})
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Info().Msgf("Serving metrics on %s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Error().Err(err).Msg("Metrics server stopped")
+		}
+	}()
+}
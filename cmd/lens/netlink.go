@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	// linkDebounce delays the detection after a change, as addresses and routes change in bursts
+	linkDebounce    = 5 * time.Second
+	netlinkRcvBuf   = 1 << 20
+	netlinkMaxBytes = 1 << 16
+)
+
+// LinkMonitor follows the rtnetlink link, address and route notifications of the interfaces of the terminals.
+// Link and address changes are recorded as network events, sessions are paused while the link of their terminal
+// is down, and the gateway and PoP are detected again right after a change instead of at the next EVENTS_INTERVAL.
+type LinkMonitor struct {
+	fd    int
+	links []*linkState
+}
+
+// linkState is what the monitor knows about the interface of one terminal.
+// It is only used by the goroutine of the monitor.
+type linkState struct {
+	terminal *Terminal
+	index    int
+	up       bool
+	addrs    map[string]bool
+	routes   map[string]bool
+	detect   *time.Timer
+}
+
+// StartLinkMonitor subscribes to the rtnetlink notifications and follows them in the background
+func StartLinkMonitor(terminals []*Terminal) (*LinkMonitor, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, netlinkRcvBuf); err != nil {
+		log.Debug().Err(err).Msg("Error enlarging the netlink receive buffer")
+	}
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	m := &LinkMonitor{fd: fd}
+	for _, t := range terminals {
+		s := &linkState{
+			terminal: t,
+			up:       true,
+			addrs:    make(map[string]bool),
+			routes:   make(map[string]bool),
+		}
+		if ifi, err := net.InterfaceByName(t.Iface); err != nil {
+			log.Warn().Err(err).Msgf("Error getting interface %s", t.Iface)
+		} else {
+			s.index = ifi.Index
+			s.up = ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagRunning != 0
+			addrs, err := ifi.Addrs()
+			if err != nil {
+				log.Warn().Err(err).Msgf("Error getting addresses of %s", t.Iface)
+			}
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+					s.addrs[ipnet.String()] = true
+				}
+			}
+		}
+		metrics.Set("lens_link_up", boolFloat(s.up), "terminal", t.ID, "iface", t.Iface)
+		if !s.up {
+			t.setLinkDown(true)
+		}
+		m.links = append(m.links, s)
+	}
+
+	go m.run()
+	log.Info().Msgf("Following link, address and route changes of %d interfaces", len(m.links))
+	return m, nil
+}
+
+func (m *LinkMonitor) Close() error {
+	return unix.Close(m.fd)
+}
+
+func (m *LinkMonitor) run() {
+	buf := make([]byte, netlinkMaxBytes)
+	for {
+		n, _, err := unix.Recvfrom(m.fd, buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.ENOBUFS) {
+			// the socket overflowed and notifications were lost
+			log.Warn().Msg("Netlink notifications were lost, detecting all gateways again")
+			for _, s := range m.links {
+				s.changed()
+			}
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Error reading netlink notifications, link changes are no longer followed")
+			return
+		}
+
+		// x/sys/unix has the constants, but not the netlink parser of syscall
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Msg("Error parsing netlink notification")
+			continue
+		}
+		for i := range msgs {
+			switch msgs[i].Header.Type {
+			case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+				m.handleLink(&msgs[i])
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+				m.handleAddr(&msgs[i])
+			case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+				m.handleRoute(&msgs[i])
+			}
+		}
+	}
+}
+
+// handleLink follows the operational state of the interfaces, which may be recreated with another index
+func (m *LinkMonitor) handleLink(msg *syscall.NetlinkMessage) {
+	if len(msg.Data) < unix.SizeofIfInfomsg {
+		return
+	}
+	// struct ifinfomsg
+	index := int(int32(binary.NativeEndian.Uint32(msg.Data[4:8])))
+	flags := binary.NativeEndian.Uint32(msg.Data[8:12])
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error parsing netlink link attributes")
+		return
+	}
+	var name string
+	for _, a := range attrs {
+		if a.Attr.Type == unix.IFLA_IFNAME {
+			name = strings.TrimRight(string(a.Value), "\x00")
+		}
+	}
+	up := msg.Header.Type == unix.RTM_NEWLINK && flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0
+
+	for _, s := range m.links {
+		if name == s.terminal.Iface {
+			s.index = index
+		} else if index != s.index {
+			continue
+		}
+		s.setUp(up)
+	}
+}
+
+// handleAddr follows the global addresses of the interfaces. Addresses are announced again
+// whenever their lifetime is refreshed, so only addresses that were not known are changes.
+func (m *LinkMonitor) handleAddr(msg *syscall.NetlinkMessage) {
+	if len(msg.Data) < unix.SizeofIfAddrmsg {
+		return
+	}
+	// struct ifaddrmsg
+	prefixLen, scope := int(msg.Data[1]), msg.Data[3]
+	index := int(binary.NativeEndian.Uint32(msg.Data[4:8]))
+	if scope != unix.RT_SCOPE_UNIVERSE {
+		return
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error parsing netlink address attributes")
+		return
+	}
+	var ip net.IP
+	for _, a := range attrs {
+		// IFA_LOCAL is the local address of point-to-point links, where IFA_ADDRESS is the peer
+		if a.Attr.Type == unix.IFA_LOCAL || (a.Attr.Type == unix.IFA_ADDRESS && ip == nil) {
+			ip = net.IP(a.Value)
+		}
+	}
+	if ip == nil || !ip.IsGlobalUnicast() {
+		return
+	}
+	addr := (&net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen, 8*len(ip))}).String()
+	added := msg.Header.Type == unix.RTM_NEWADDR
+
+	for _, s := range m.links {
+		if index != s.index || s.addrs[addr] == added {
+			continue
+		}
+		event := newNetworkEvent(eventAddress, "", addr)
+		if added {
+			s.addrs[addr] = true
+		} else {
+			delete(s.addrs, addr)
+			event.From, event.To = addr, ""
+		}
+		s.terminal.recordNetworkEvents([]NetworkEvent{event})
+		s.changed()
+	}
+}
+
+// handleRoute follows the default routes through the interfaces
+func (m *LinkMonitor) handleRoute(msg *syscall.NetlinkMessage) {
+	if len(msg.Data) < unix.SizeofRtMsg {
+		return
+	}
+	// struct rtmsg
+	family, dstLen, table := msg.Data[0], msg.Data[1], uint32(msg.Data[4])
+	if dstLen != 0 {
+		return
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		log.Debug().Err(err).Msg("Error parsing netlink route attributes")
+		return
+	}
+	var oif int
+	var gateway net.IP
+	for _, a := range attrs {
+		switch {
+		case a.Attr.Type == unix.RTA_OIF && len(a.Value) >= 4:
+			oif = int(binary.NativeEndian.Uint32(a.Value))
+		case a.Attr.Type == unix.RTA_TABLE && len(a.Value) >= 4:
+			table = binary.NativeEndian.Uint32(a.Value)
+		case a.Attr.Type == unix.RTA_GATEWAY:
+			gateway = net.IP(a.Value)
+		}
+	}
+	if table != unix.RT_TABLE_MAIN {
+		return
+	}
+	route := fmt.Sprintf("%d/%s", family, gateway)
+	added := msg.Header.Type == unix.RTM_NEWROUTE
+
+	for _, s := range m.links {
+		if oif != s.index || s.routes[route] == added {
+			continue
+		}
+		if added {
+			s.routes[route] = true
+			log.Info().Msgf("Default route via %s added on %s", gateway, s.terminal.Iface)
+		} else {
+			delete(s.routes, route)
+			log.Info().Msgf("Default route via %s removed on %s", gateway, s.terminal.Iface)
+		}
+		s.changed()
+	}
+}
+
+func (s *linkState) setUp(up bool) {
+	if up == s.up {
+		return
+	}
+	s.up = up
+	event := newNetworkEvent(eventLink, "up", "down")
+	if up {
+		event.From, event.To = "down", "up"
+	}
+	s.terminal.recordNetworkEvents([]NetworkEvent{event})
+	metrics.Set("lens_link_up", boolFloat(up), "terminal", s.terminal.ID, "iface", s.terminal.Iface)
+
+	s.terminal.setLinkDown(!up)
+	if up {
+		s.changed()
+	}
+}
+
+// changed detects the gateway and PoP of the terminal again, once the changes have settled
+func (s *linkState) changed() {
+	externalIPs.Invalidate(s.terminal.Iface)
+	if s.detect != nil {
+		s.detect.Reset(linkDebounce)
+		return
+	}
+	t := s.terminal
+	s.detect = time.AfterFunc(linkDebounce, func() {
+		if t.linkDown() {
+			return
+		}
+		log.Info().Msgf("Detecting the gateway after a change of %s%s", t.Iface, t.logSuffix())
+		t.DetectGateway()
+	})
+}
+
+// setLinkDown pauses the sessions of the terminal while its link is down.
+// Running sessions are ended, and wait in waitLink to be restarted when the link is up again.
+func (t *Terminal) setLinkDown(down bool) {
+	t.mu.Lock()
+	if down == (t.linkUp != nil) {
+		t.mu.Unlock()
+		return
+	}
+	if down {
+		t.linkUp = make(chan struct{})
+	} else {
+		close(t.linkUp)
+		t.linkUp = nil
+	}
+	t.mu.Unlock()
+
+	if down {
+		t.endRunningSessions(fmt.Errorf("%w: link of %s is down", errNetworkChange, t.Iface))
+	}
+}
+
+func (t *Terminal) linkDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.linkUp != nil
+}
+
+// waitLink waits until the link of the terminal is up, and reports false if it is still down at end
+func (t *Terminal) waitLink(end time.Time) bool {
+	t.mu.Lock()
+	linkUp := t.linkUp
+	t.mu.Unlock()
+	if linkUp == nil {
+		return true
+	}
+
+	log.Warn().Msgf("Link of %s is down, pausing sessions%s", t.Iface, t.logSuffix())
+	timer := time.NewTimer(time.Until(end))
+	defer timer.Stop()
+	select {
+	case <-linkUp:
+		log.Info().Msgf("Link of %s is up, resuming sessions%s", t.Iface, t.logSuffix())
+		return time.Now().Before(end)
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clarkzjw/starlink-grpc-golang/pkg/spacex.com/api/device"
+	"github.com/phuslu/log"
+)
+
+const (
+	// DishOutage timestamps count nanoseconds since the GPS epoch (1980-01-06),
+	// which is ahead of UTC by the accumulated leap seconds.
+	gpsEpochUnix   = 315964800
+	gpsLeapSeconds = 18
+
+	// outages are kept in memory this long to annotate sessions that ended recently
+	outageRetention = 48 * time.Hour
+)
+
+// OutageRecord is one line of an outage-<datetime>.jsonl file
+type OutageRecord struct {
+	Type             string `json:"type"`
+	Cause            string `json:"cause"`
+	Start            string `json:"start"`
+	End              string `json:"end"`
+	StartTimestampNs int64  `json:"start_timestamp_ns"`
+	DurationNs       uint64 `json:"duration_ns"`
+	DidSwitch        bool   `json:"did_switch"`
+	Source           string `json:"source"`
+	Ongoing          bool   `json:"ongoing,omitempty"`
+	// Correction replaces the earlier record of the outage with the same StartTimestampNs,
+	// whose duration GetStatus reported before GetHistory reported the final one
+	Correction bool `json:"correction,omitempty"`
+
+	start time.Time
+	end   time.Time
+}
+
+func newOutageRecord(o *device.DishOutage, source string) *OutageRecord {
+	start := gpsNsToTime(o.GetStartTimestampNs())
+	end := start.Add(time.Duration(o.GetDurationNs()))
+	return &OutageRecord{
+		Type:             "outage",
+		Cause:            o.GetCause().String(),
+		Start:            start.Format(time.RFC3339Nano),
+		End:              end.Format(time.RFC3339Nano),
+		StartTimestampNs: o.GetStartTimestampNs(),
+		DurationNs:       o.GetDurationNs(),
+		DidSwitch:        o.GetDidSwitch(),
+		Source:           source,
+		start:            start,
+		end:              end,
+	}
+}
+
+func gpsNsToTime(ns int64) time.Time {
+	return time.Unix(gpsEpochUnix-gpsLeapSeconds, ns).UTC()
+}
+
+// OutageTracker deduplicates DishOutage records reported by GetStatus (the ongoing outage)
+// and GetHistory (recently finished outages), and writes each outage once when it has ended,
+// and again as a correction if GetHistory reports a longer duration than GetStatus last did.
+type OutageTracker struct {
+	dish     *DishClient
+	recorder *Recorder
+
+	mu       sync.Mutex
+	recorded map[int64]*OutageRecord
+	ongoing  *OutageRecord
+}
+
+func NewOutageTracker(t *Terminal) *OutageTracker {
+	tracker := &OutageTracker{
+		dish:     t.dish,
+		recorder: NewRecorder("outage", t, 24*time.Hour),
+		recorded: make(map[int64]*OutageRecord),
+	}
+	tracker.load()
+	return tracker
+}
+
+// load seeds the recorded outages from the files a previous run left, before they are finalized,
+// so that the outages still in the history of the dish are not written again after a restart
+func (t *OutageTracker) load() {
+	cutoff := time.Now().Add(-outageRetention)
+	for _, filename := range t.recorder.leftovers() {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error reading outage file %s", filename)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec OutageRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				log.Debug().Err(err).Msgf("Error parsing outage record in %s", filename)
+				continue
+			}
+			rec.Correction = false
+			rec.start = gpsNsToTime(rec.StartTimestampNs)
+			rec.end = rec.start.Add(time.Duration(rec.DurationNs))
+			if rec.end.After(cutoff) {
+				// a correction follows the record it replaces
+				t.recorded[rec.StartTimestampNs] = &rec
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Error().Err(err).Msgf("Error reading outage file %s", filename)
+		}
+		if err := f.Close(); err != nil {
+			log.Debug().Err(err).Msgf("Error closing outage file %s", filename)
+		}
+	}
+	if len(t.recorded) > 0 {
+		log.Info().Msgf("Loaded %d recorded outages of the previous run", len(t.recorded))
+	}
+}
+
+// ObserveStatus tracks the ongoing outage reported by GetStatus.
+// The outage is recorded once the dish no longer reports it, in case GetHistory is not polled.
+func (t *OutageTracker) ObserveStatus(status *device.DishGetStatusResponse) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if o := status.GetOutage(); o != nil && o.GetStartTimestampNs() != 0 {
+		rec := newOutageRecord(o, "status")
+		rec.Ongoing = true
+		if t.ongoing != nil && t.ongoing.StartTimestampNs != rec.StartTimestampNs {
+			// a new outage started, the previous one has ended
+			t.ongoing.Ongoing = false
+			t.recordLocked(t.ongoing)
+		}
+		t.ongoing = rec
+		return
+	}
+
+	if t.ongoing != nil {
+		t.ongoing.Ongoing = false
+		t.recordLocked(t.ongoing)
+		t.ongoing = nil
+	}
+}
+
+// ObserveHistory records the finished outages reported by GetHistory
+func (t *OutageTracker) ObserveHistory(history *device.DishGetHistoryResponse) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	outages := history.GetOutages()
+	sort.Slice(outages, func(i, j int) bool {
+		return outages[i].GetStartTimestampNs() < outages[j].GetStartTimestampNs()
+	})
+	for _, o := range outages {
+		rec := newOutageRecord(o, "history")
+		if t.ongoing != nil && t.ongoing.StartTimestampNs == rec.StartTimestampNs {
+			t.ongoing = nil
+		}
+		t.recordLocked(rec)
+	}
+}
+
+// recordLocked writes an outage that has ended, unless it was recorded already.
+// History reports the final duration, while status may have seen the outage last before it ended,
+// so an outage that turns out longer than recorded is written again as a correction.
+func (t *OutageTracker) recordLocked(rec *OutageRecord) {
+	prev, ok := t.recorded[rec.StartTimestampNs]
+	if ok && rec.DurationNs <= prev.DurationNs {
+		return
+	}
+	t.recorded[rec.StartTimestampNs] = rec
+
+	written := *rec
+	if ok {
+		written.Correction = true
+		log.Info().Msgf("Dish outage: %s at %s lasted %s, not %s", rec.Cause, rec.Start, time.Duration(rec.DurationNs), time.Duration(prev.DurationNs))
+	} else {
+		log.Info().Msgf("Dish outage: %s at %s for %s", rec.Cause, rec.Start, time.Duration(rec.DurationNs))
+	}
+	if err := t.recorder.Write(&written); err != nil {
+		log.Error().Err(err).Msg("Error recording dish outage")
+	}
+
+	cutoff := time.Now().Add(-outageRetention)
+	for k, r := range t.recorded {
+		if r.end.Before(cutoff) {
+			delete(t.recorded, k)
+		}
+	}
+}
+
+// Poll reads GetStatus and GetHistory once, used when no collector feeds the tracker
+func (t *OutageTracker) Poll() {
+	if t == nil {
+		return
+	}
+	exporter, err := t.dish.Get()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating gRPC client to Starlink dish")
+		return
+	}
+	status, err := exporter.CollectDishStatus()
+	if err != nil {
+		log.Error().Err(err).Msg("Error collecting dish status for outage tracking")
+		t.dish.Reset()
+		return
+	}
+	t.ObserveStatus(status)
+
+	history, err := exporter.CollectDishHistory()
+	if err != nil {
+		log.Error().Err(err).Msg("Error collecting dish history for outage tracking")
+		t.dish.Reset()
+		return
+	}
+	t.ObserveHistory(history)
+}
+
+// Between returns the outages, including an ongoing one, that overlap [start, end]
+func (t *OutageTracker) Between(start, end time.Time) []OutageRecord {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var outages []OutageRecord
+	for _, r := range t.recorded {
+		if r.start.Before(end) && r.end.After(start) {
+			outages = append(outages, *r)
+		}
+	}
+	if r := t.ongoing; r != nil && r.start.Before(end) {
+		outages = append(outages, *r)
+	}
+	sort.Slice(outages, func(i, j int) bool {
+		return outages[i].StartTimestampNs < outages[j].StartTimestampNs
+	})
+	return outages
+}
@@ -1,189 +1,266 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
-	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/phuslu/log"
 )
 
-func ICMPPing(target string, interval float64) {
-	if PoP == "" {
-		log.Error().Msg("PoP is empty, skipping ICMP ping")
-		return
+// PingSession probes all ping targets of the terminal concurrently, so that their results cover the same time window
+func (t *Terminal) PingSession() {
+	gateway, _, _ := t.Gateway()
+	if gateway == "" && slices.ContainsFunc(t.PingTargets, func(p PingTarget) bool { return p.Host == gatewayTarget }) {
+		log.Warn().Msgf("Gateway is unknown, detecting it again before the ICMP ping session%s", t.logSuffix())
+		t.DetectGateway()
 	}
+	pop := t.PoP()
+	if pop == unknownPoP {
+		log.Warn().Msgf("PoP is unknown, ICMP ping files are tagged %q%s", unknownPoP, t.logSuffix())
+	}
+	t.location.Prefetch()
+
+	datetime := datetimeString()
+	var wg sync.WaitGroup
+	for _, target := range t.PingTargets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.pingTarget(target, pop, datetime)
+		}()
+	}
+	wg.Wait()
 
-	ctx, cancel := context.WithTimeout(context.Background(), sessionDuration)
+	notify()
+}
+
+// pingTarget runs the ping session of one target. The target is resolved when the session starts,
+// and the session is skipped if that fails. When a network event ends it, it is resolved again
+// and restarted with the new PoP for the rest of its duration, so that each file has a single PoP.
+func (t *Terminal) pingTarget(pt PingTarget, pop, datetime string) {
+	end := time.Now().Add(pt.Duration.Duration)
+	for {
+		if !t.waitLink(end) {
+			log.Error().Msgf("Link of %s stayed down, skipping ICMP ping to %s%s", t.Iface, cmp.Or(pt.Name, pt.Host), t.logSuffix())
+			return
+		}
+		// a session that starts late or is restarted runs for, and is named by, the rest of the duration
+		duration := pt.Duration
+		remaining := time.Until(end)
+		if remaining < pt.Interval.Duration {
+			return
+		}
+		if remaining < pt.Duration.Duration-time.Second {
+			duration = ConfigDuration{Duration: remaining.Round(time.Second)}
+		}
+		addr, err := t.resolveTarget(pt.Host)
+		if err != nil {
+			log.Error().Err(err).Msgf("Skipping ICMP ping to %s%s", cmp.Or(pt.Name, pt.Host), t.logSuffix())
+			observeSession(t.ID, "ping", false)
+			return
+		}
+		if !t.ICMPPing(pt, addr, pop, datetime, duration) {
+			return
+		}
+		pop = t.PoP()
+		datetime = datetimeString()
+		log.Info().Msgf("Restarting ICMP ping to %s for %s%s", cmp.Or(pt.Name, pt.Host), time.Until(end).Round(time.Second), t.logSuffix())
+	}
+}
+
+// ICMPPing runs the ping session of one target at addr for duration, and reports whether a network event ended it early.
+// The output files are named ping[-<terminal>]-<PoP>-<target>-<interval>-<duration>-<datetime>,
+// where target is the name of the target if set, its address for the gateway and the PoP anycast address, or its host.
+func (t *Terminal) ICMPPing(pt PingTarget, addr net.IP, pop, datetime string, duration ConfigDuration) (interrupted bool) {
+	target := pt.Host
+	if target == gatewayTarget || target == popTarget {
+		target = addr.String()
+	}
+	label := cmp.Or(pt.Name, target)
+	defer activeSessions.track(t.ID, "ping", target)()
+
+	ctx, cancel := context.WithTimeout(t.sessionContext(), duration.Duration)
 	defer cancel()
 
 	today := checkDirectory()
-	filename := fmt.Sprintf("ping-%s-%s-%s-%s-%s.txt", PoP, target, Interval, Duration, datetimeString())
-	fullFilename := path.Join("data", today, filename)
+	base := fmt.Sprintf("%s-%s-%s-%s-%s-%s", t.name("ping"), pop, label, pt.Interval, duration, datetime)
 
-	cmd := exec.Command(PingBinary, "-D", "-c", strconv.Itoa(Count), "-i", fmt.Sprintf("%.2f", interval), "-I", Iface, target)
-	log.Info().Msgf("ping command: %s", cmd.String())
+	prober, err := NewICMPProber(t.Iface, addr)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error creating ICMP prober%s", t.logSuffix())
+		observeSession(t.ID, "ping", false)
+		return false
+	}
+	defer prober.Close()
+	prober.Interval = pt.Interval.Duration
+	prober.Count = int(duration.Duration / pt.Interval.Duration)
 
-	f, err := os.Create(fullFilename)
+	outputs, err := newPingOutputs(path.Join(DataDir, today), base, PingFormats)
 	if err != nil {
-		log.Error().Err(err).Msg("Error creating ping output file")
-		return
+		log.Error().Err(err).Msg("Error creating ping output files")
+		observeSession(t.ID, "ping", false)
+		return false
+	}
+	if err := outputs.WriteHeader(prober, t.ID, pop); err != nil {
+		log.Error().Err(err).Msg("Error writing ping output file")
 	}
-	defer f.Close()
 
-	mw := io.MultiWriter(f)
-	cmd.Stdout = mw
-	cmd.Stderr = mw
+	meta := t.newSessionMeta("ping", target)
+	meta.TargetAddr = addr.String()
+	log.Info().Msgf("Started ICMP prober for target %s (%s) on %s, interval %s, count %d, raw socket: %t",
+		target, addr, t.Iface, prober.Interval, prober.Count, prober.Privileged())
 
-	if err := cmd.Start(); err != nil {
-		log.Error().Err(err).Msg("Error starting ping process")
-		return
+	stats, runErr := prober.Run(ctx, func(r ProbeResult) {
+		if err := outputs.WriteResult(&r); err != nil {
+			log.Error().Err(err).Msg("Error writing ping output file")
+		}
+	})
+	if runErr != nil {
+		log.Error().Err(runErr).Msg("ICMP prober exited with error")
+	}
+	interrupted = networkChanged(ctx)
+	if interrupted {
+		meta.Interrupted = context.Cause(ctx).Error()
+		log.Info().Msgf("ICMP prober for target %s ended early: %s", target, meta.Interrupted)
+	}
+	if err := outputs.WriteFooter(&stats); err != nil {
+		log.Error().Err(err).Msg("Error writing ping output file")
+	}
+	if err := outputs.close(); err != nil {
+		log.Error().Err(err).Msg("Error closing ping output file")
 	}
 
-	log.Info().Msgf("Started ping process (PID %d) for target %s", cmd.Process.Pid, target)
-
-	waitErr := make(chan error)
-	go func() {
-		waitErr <- cmd.Wait()
-		close(waitErr)
-	}()
+	log.Info().Msgf("ICMP prober for target %s finished: %d transmitted, %d received, %.2f%% packet loss",
+		target, stats.Transmitted, stats.Received, stats.Loss())
 
-	select {
-	case err := <-waitErr:
-		if err != nil {
-			log.Error().Err(err).Msg("Ping process exited with error")
-		}
-	case <-ctx.Done():
-		if cmd.Process != nil {
-			if err := cmd.Process.Signal(os.Interrupt); err != nil {
-				log.Printf("Error sending interrupt to ping process: %v", err)
-				if err := cmd.Process.Kill(); err != nil {
-					log.Printf("Error killing ping process: %v", err)
-				} else {
-					if err := <-waitErr; err != nil {
-						log.Error().Err(err).Msg("Ping process exited with error after kill")
-					}
-				}
-			} else {
-				select {
-				case err := <-waitErr:
-					if err != nil {
-						log.Error().Err(err).Msg("Ping process exited with error after interrupt")
-					}
-				case <-time.After(5 * time.Second):
-					if err := cmd.Process.Kill(); err != nil {
-						log.Printf("Error killing ping process: %v", err)
-					}
-					if err := <-waitErr; err != nil {
-						log.Error().Err(err).Msg("Ping process exited with error after kill")
-					}
-				}
-			}
-		}
+	observeSession(t.ID, "ping", stats.Received > 0)
+	metrics.Set("lens_last_session_loss_percent", stats.Loss(), "terminal", t.ID, "kind", "ping", "target", label)
+	if stats.Received > 0 {
+		_, avgMs, _, _ := stats.RTT()
+		metrics.Set("lens_last_session_rtt_avg_ms", avgMs, "terminal", t.ID, "kind", "ping", "target", label)
 	}
 
-	fullFilename, err = compress(path.Join(DataDir, today), filename)
-	if err != nil {
-		log.Error().Err(err).Msg("Error compressing ping output file")
-		return
+	exitStatus := 0
+	switch {
+	case runErr != nil:
+		exitStatus = 2
+	case stats.Received == 0:
+		// a total loss is valid data, and archived with the exit status of ping
+		log.Error().Msgf("%s received no replies", base)
+		exitStatus = 1
+		runErr = fmt.Errorf("no replies from %s", addr)
 	}
+	meta.finish(exitStatus, runErr)
+	meta.archive(path.Join(DataDir, today), base, outputs.filenames())
+	return interrupted
+}
 
-	if EnableSwift {
-		conn, err := NewSwiftConn(SwiftUsername, SwiftAPIKey, SwiftAuthURL, SwiftDomain, SwiftTenant)
-		if err != nil {
-			log.Error().Err(err).Msg("Error creating Swift client")
+// IRTTPing runs an IRTT session. When a network event ends it, it is restarted
+// with the new PoP and addresses for the rest of its duration, so that each file has a single PoP.
+func (t *Terminal) IRTTPing() {
+	end := time.Now().Add(sessionDuration)
+	duration := Duration
+	t.location.Prefetch()
+	for {
+		if !t.waitLink(end) {
+			log.Error().Msgf("Link of %s stayed down, skipping IRTT ping%s", t.Iface, t.logSuffix())
 			return
 		}
-		localFilename := fullFilename
-
-		year := strconv.Itoa(time.Now().Year())
-		month := fmt.Sprintf("%02d", time.Now().Month())
-		day := time.Now().UTC().Format("2006-01-02")
-		targetFilename := path.Join(ClientName, "ping", year, month, day, path.Base(localFilename))
-		log.Info().Msgf("Uploading %s to Swift: %s", localFilename, targetFilename)
-
-		if err := UploadToSwift(conn, SwiftContainer, localFilename, targetFilename); err != nil {
-			log.Error().Err(err).Msgf("Error uploading %s to Swift container %s", localFilename, SwiftContainer)
+		remaining := time.Until(end).Round(time.Second)
+		if remaining < max(pingInterval, time.Second) {
+			return
+		}
+		if remaining < sessionDuration-time.Second {
+			duration = remaining.String()
+			log.Info().Msgf("Restarting IRTT ping for %s%s", duration, t.logSuffix())
+		}
+		if !t.irttSession(duration) {
+			return
 		}
-		defer func() {
-			if err := os.Remove(localFilename); err != nil {
-				log.Error().Err(err).Msgf("Error removing local file %s", localFilename)
-			}
-		}()
 	}
-
-	notify()
 }
 
-func IRTTPing() {
-	if PoP == "" {
-		log.Error().Msg("PoP is empty, skipping IRTT ping")
-		return
+// irttSession runs irtt for duration, and reports whether a network event ended it early
+func (t *Terminal) irttSession(duration string) (interrupted bool) {
+	_, _, ipVersion := t.Gateway()
+	if ipVersion == 0 {
+		log.Error().Msgf("Gateway is empty, skipping IRTT ping%s", t.logSuffix())
+		observeSession(t.ID, "irtt", false)
+		return false
+	}
+	pop := t.PoP()
+	if pop == unknownPoP {
+		log.Warn().Msgf("PoP is unknown, IRTT ping files are tagged %q%s", unknownPoP, t.logSuffix())
 	}
+	defer activeSessions.track(t.ID, "irtt", IRTTHostPort)()
 
-	ctx, cancel := context.WithTimeout(context.Background(), sessionDuration+time.Minute*10)
+	ctx, cancel := context.WithTimeout(t.sessionContext(), sessionDuration+time.Minute*10)
+	defer cancel()
 
 	today := checkDirectory()
 
-	filename := fmt.Sprintf("irtt-%s-%s-%s-%s.json.gz", PoP, Interval, Duration, datetimeString())
-	fullFilename := path.Join("data", today, filename)
-
-	go func(ctx context.Context) {
-		defer cancel()
-
-		var local string
-		if IPVersion == 6 && len(externalIPv6) > 0 {
-			local = fmt.Sprintf("--local=[%s]", externalIPv6)
-		} else {
-			local = fmt.Sprintf("--local=%s", IRTTLocalIP)
-		}
-
-		cmd := exec.CommandContext(ctx,
-			"irtt",
-			"client",
-			fmt.Sprintf("-%d", IPVersion),
-			"-Q",
-			"-i", Interval,
-			"-d", Duration,
-			local,
-			IRTTHostPort,
-			"-o", fullFilename)
-		log.Info().Msgf("irtt command: %s", cmd.String())
-
-		if err := cmd.Run(); err != nil {
-			log.Error().Err(err).Msg("Error running irtt command")
-		}
-	}(ctx)
+	base := fmt.Sprintf("%s-%s-%s-%s-%s", t.name("irtt"), pop, Interval, duration, datetimeString())
+	filename := base + ".json.gz"
+	fullFilename := path.Join(DataDir, today, filename)
+	meta := t.newSessionMeta("irtt", IRTTHostPort)
 
-	<-ctx.Done()
+	t.mu.Lock()
+	externalIPv6 := t.externalIPv6
+	t.mu.Unlock()
 
-	if EnableSwift {
-		conn, err := NewSwiftConn(SwiftUsername, SwiftAPIKey, SwiftAuthURL, SwiftDomain, SwiftTenant)
-		if err != nil {
-			log.Error().Err(err).Msg("Error creating Swift client")
-			return
-		}
-		localFilename := fullFilename
+	var local string
+	if ipVersion == 6 && len(externalIPv6) > 0 {
+		local = fmt.Sprintf("--local=[%s]", externalIPv6)
+	} else {
+		local = fmt.Sprintf("--local=%s", t.IRTTLocalIP)
+	}
 
-		year := strconv.Itoa(time.Now().Year())
-		month := fmt.Sprintf("%02d", time.Now().Month())
-		day := time.Now().UTC().Format("2006-01-02")
+	cmd := exec.CommandContext(ctx,
+		"irtt",
+		"client",
+		fmt.Sprintf("-%d", ipVersion),
+		"-Q",
+		"-i", Interval,
+		"-d", duration,
+		local,
+		IRTTHostPort,
+		"-o", fullFilename)
+	// irtt writes its results when it is interrupted, so that a session ended by a network event is kept
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	meta.Command = cmd.String()
+	log.Info().Msgf("irtt command: %s", cmd.String())
 
-		targetFilename := path.Join(ClientName, "irtt", year, month, day, path.Base(localFilename))
-		if err := UploadToSwift(conn, SwiftContainer, localFilename, targetFilename); err != nil {
-			log.Error().Err(err).Msgf("Error uploading %s to Swift container %s", localFilename, SwiftContainer)
+	exitStatus := 0
+	err := cmd.Run()
+	interrupted = networkChanged(ctx)
+	if interrupted {
+		meta.Interrupted = context.Cause(ctx).Error()
+		log.Info().Msgf("irtt ended early: %s", meta.Interrupted)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Error running irtt command")
+	}
+	if err != nil {
+		exitStatus = 2
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+			exitStatus = exitErr.ExitCode()
 		}
-		defer func() {
-			if err := os.Remove(localFilename); err != nil {
-				log.Error().Err(err).Msgf("Error removing local file %s", localFilename)
-			}
-		}()
 	}
+	observeSession(t.ID, "irtt", err == nil || interrupted)
+
+	meta.finish(exitStatus, err)
+	meta.archive(path.Join(DataDir, today), base, []string{filename})
 
 	notify()
+	return interrupted
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PingFormatText  = "text"
+	PingFormatJSONL = "jsonl"
+	PingFormatCSV   = "csv"
+
+	pingRecordVersion = 1
+)
+
+// ProbeWriter serializes a ping session, one WriteResult call per probe outcome
+type ProbeWriter interface {
+	WriteHeader(h *pingSessionHeader) error
+	WriteResult(r *ProbeResult) error
+	WriteFooter(h *pingSessionHeader, stats *ProbeStats) error
+}
+
+// PingTextWriter renders probe results in the format of iputils `ping -D`,
+// so that files produced by the native prober stay compatible with existing datasets.
+type PingTextWriter struct {
+	w io.Writer
+}
+
+func NewPingTextWriter(w io.Writer) *PingTextWriter {
+	return &PingTextWriter{w: w}
+}
+
+// WriteHeader writes e.g.
+// PING 100.64.0.1 (100.64.0.1) from 100.76.1.2 eth0: 56(84) bytes of data.
+func (p *PingTextWriter) WriteHeader(h *pingSessionHeader) error {
+	var err error
+	if h.IPVersion == 4 {
+		_, err = fmt.Fprintf(p.w, "PING %s (%s) from %s %s: %d(%d) bytes of data.\n",
+			h.Target, h.Target, h.Source, h.Iface, h.PayloadSize, h.PayloadSize+28)
+	} else {
+		_, err = fmt.Fprintf(p.w, "PING %s (%s) from %s %s: %d data bytes\n",
+			h.Target, h.Target, h.Source, h.Iface, h.PayloadSize)
+	}
+	return err
+}
+
+// WriteResult writes e.g.
+// [1763071200.038727] 64 bytes from 100.64.0.1: icmp_seq=1 ttl=63 time=33.1 ms
+// Timeouts are not printed, the same as ping without -O.
+func (p *PingTextWriter) WriteResult(r *ProbeResult) error {
+	var err error
+	switch r.Status {
+	case ProbeReply, ProbeDuplicate:
+		dup := ""
+		if r.Status == ProbeDuplicate {
+			dup = " (DUP!)"
+		}
+		_, err = fmt.Fprintf(p.w, "[%s] %d bytes from %s: icmp_seq=%d ttl=%d time=%s ms%s\n",
+			unixMicroString(r.Received), r.Size, r.From, r.WireSeq(), r.TTL, pingRTTString(r.RTT), dup)
+	case ProbeUnreachable:
+		_, err = fmt.Fprintf(p.w, "[%s] From %s icmp_seq=%d Destination Unreachable\n",
+			unixMicroString(r.Received), r.From, r.WireSeq())
+	case ProbeTimeout:
+	}
+	return err
+}
+
+// WriteFooter writes the ping statistics summary
+func (p *PingTextWriter) WriteFooter(h *pingSessionHeader, stats *ProbeStats) error {
+	if _, err := fmt.Fprintf(p.w, "\n--- %s ping statistics ---\n", h.Target); err != nil {
+		return err
+	}
+
+	extra := ""
+	if stats.Duplicates > 0 {
+		extra += fmt.Sprintf("+%d duplicates, ", stats.Duplicates)
+	}
+	if stats.Errors > 0 {
+		extra += fmt.Sprintf("+%d errors, ", stats.Errors)
+	}
+	if _, err := fmt.Fprintf(p.w, "%d packets transmitted, %d received, %s%g%% packet loss, time %dms\n",
+		stats.Transmitted, stats.Received, extra, stats.Loss(), stats.End.Sub(stats.Start).Milliseconds()); err != nil {
+		return err
+	}
+
+	if stats.Received > 0 {
+		minMs, avgMs, maxMs, mdevMs := stats.RTT()
+		if _, err := fmt.Fprintf(p.w, "rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms\n", minMs, avgMs, maxMs, mdevMs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pingSessionHeader is the first record of a structured ping output file
+type pingSessionHeader struct {
+	Type        string  `json:"type"`
+	Version     int     `json:"version"`
+	Client      string  `json:"client"`
+	Terminal    string  `json:"terminal,omitempty"`
+	PoP         string  `json:"pop"`
+	Target      string  `json:"target"`
+	Source      string  `json:"source"`
+	Iface       string  `json:"iface"`
+	IPVersion   int     `json:"ip_version"`
+	IntervalMs  float64 `json:"interval_ms"`
+	Count       int     `json:"count"`
+	PayloadSize int     `json:"payload_size"`
+	TimeoutMs   float64 `json:"timeout_ms"`
+	Start       string  `json:"start"`
+}
+
+// pingProbeRecord is written once per probe outcome
+type pingProbeRecord struct {
+	Type    string      `json:"type"`
+	Seq     int         `json:"seq"`
+	ICMPSeq int         `json:"icmp_seq"`
+	SendTS  json.Number `json:"send_ts"`
+	RecvTS  json.Number `json:"recv_ts,omitempty"`
+	RTTMs   *float64    `json:"rtt_ms,omitempty"`
+	TTL     int         `json:"ttl,omitempty"`
+	Size    int         `json:"size,omitempty"`
+	From    string      `json:"from,omitempty"`
+	Status  ProbeStatus `json:"status"`
+}
+
+// pingSessionSummary is the last record of a structured ping output file
+type pingSessionSummary struct {
+	Type        string  `json:"type"`
+	Transmitted int     `json:"transmitted"`
+	Received    int     `json:"received"`
+	Duplicates  int     `json:"duplicates"`
+	Errors      int     `json:"errors"`
+	LossPercent float64 `json:"loss_percent"`
+	RTTMinMs    float64 `json:"rtt_min_ms"`
+	RTTAvgMs    float64 `json:"rtt_avg_ms"`
+	RTTMaxMs    float64 `json:"rtt_max_ms"`
+	RTTMdevMs   float64 `json:"rtt_mdev_ms"`
+	End         string  `json:"end"`
+}
+
+func newPingSessionHeader(prober *ICMPProber, terminal, pop string) *pingSessionHeader {
+	return &pingSessionHeader{
+		Type:        "session",
+		Version:     pingRecordVersion,
+		Client:      ClientName,
+		Terminal:    terminal,
+		PoP:         pop,
+		Target:      prober.Target.String(),
+		Source:      prober.Source.String(),
+		Iface:       prober.Iface,
+		IPVersion:   prober.version,
+		IntervalMs:  float64(prober.Interval.Microseconds()) / 1000.0,
+		Count:       prober.Count,
+		PayloadSize: prober.PayloadSize,
+		TimeoutMs:   float64(prober.Timeout.Milliseconds()),
+		Start:       time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func newPingProbeRecord(r *ProbeResult) *pingProbeRecord {
+	rec := &pingProbeRecord{
+		Type:    "probe",
+		Seq:     r.Seq,
+		ICMPSeq: r.WireSeq(),
+		SendTS:  json.Number(unixMicroString(r.Sent)),
+		Status:  r.Status,
+	}
+	if r.Status != ProbeTimeout {
+		rtt := float64(r.RTT.Microseconds()) / 1000.0
+		rec.RecvTS = json.Number(unixMicroString(r.Received))
+		rec.RTTMs = &rtt
+		rec.TTL = r.TTL
+		rec.Size = r.Size
+		rec.From = r.From
+	}
+	return rec
+}
+
+func newPingSessionSummary(stats *ProbeStats) *pingSessionSummary {
+	minMs, avgMs, maxMs, mdevMs := stats.RTT()
+	return &pingSessionSummary{
+		Type:        "summary",
+		Transmitted: stats.Transmitted,
+		Received:    stats.Received,
+		Duplicates:  stats.Duplicates,
+		Errors:      stats.Errors,
+		LossPercent: stats.Loss(),
+		RTTMinMs:    minMs,
+		RTTAvgMs:    avgMs,
+		RTTMaxMs:    maxMs,
+		RTTMdevMs:   mdevMs,
+		End:         stats.End.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// PingJSONLWriter writes one JSON object per line:
+// a "session" header, one "probe" record per probe and a "summary" trailer.
+type PingJSONLWriter struct {
+	enc *json.Encoder
+}
+
+func NewPingJSONLWriter(w io.Writer) *PingJSONLWriter {
+	return &PingJSONLWriter{enc: json.NewEncoder(w)}
+}
+
+func (p *PingJSONLWriter) WriteHeader(h *pingSessionHeader) error {
+	return p.enc.Encode(h)
+}
+
+func (p *PingJSONLWriter) WriteResult(r *ProbeResult) error {
+	return p.enc.Encode(newPingProbeRecord(r))
+}
+
+func (p *PingJSONLWriter) WriteFooter(_ *pingSessionHeader, stats *ProbeStats) error {
+	return p.enc.Encode(newPingSessionSummary(stats))
+}
+
+// PingCSVWriter writes one row per probe.
+// The session header and summary are written as "# key=value" comment lines.
+type PingCSVWriter struct {
+	w   io.Writer
+	csv *csv.Writer
+}
+
+func NewPingCSVWriter(w io.Writer) *PingCSVWriter {
+	return &PingCSVWriter{w: w, csv: csv.NewWriter(w)}
+}
+
+func (p *PingCSVWriter) writeComments(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(p.w, "# %s=%v\n", k, fields[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PingCSVWriter) WriteHeader(h *pingSessionHeader) error {
+	if err := p.writeComments(h); err != nil {
+		return err
+	}
+	if err := p.csv.Write([]string{"seq", "icmp_seq", "send_ts", "recv_ts", "rtt_ms", "ttl", "size", "from", "status"}); err != nil {
+		return err
+	}
+	p.csv.Flush()
+	return p.csv.Error()
+}
+
+func (p *PingCSVWriter) WriteResult(r *ProbeResult) error {
+	rec := newPingProbeRecord(r)
+	rtt, ttl, size := "", "", ""
+	if rec.RTTMs != nil {
+		rtt = strconv.FormatFloat(*rec.RTTMs, 'f', 3, 64)
+		ttl = strconv.Itoa(rec.TTL)
+		size = strconv.Itoa(rec.Size)
+	}
+	return p.csv.Write([]string{
+		strconv.Itoa(rec.Seq),
+		strconv.Itoa(rec.ICMPSeq),
+		rec.SendTS.String(),
+		rec.RecvTS.String(),
+		rtt,
+		ttl,
+		size,
+		rec.From,
+		string(rec.Status),
+	})
+}
+
+func (p *PingCSVWriter) WriteFooter(_ *pingSessionHeader, stats *ProbeStats) error {
+	p.csv.Flush()
+	if err := p.csv.Error(); err != nil {
+		return err
+	}
+	return p.writeComments(newPingSessionSummary(stats))
+}
+
+// pingOutput is one output file of a ping session in a given format
+type pingOutput struct {
+	filename string
+	f        *os.File
+	buf      *bufio.Writer
+	writer   ProbeWriter
+}
+
+// pingOutputs fans out probe results to every configured output format
+type pingOutputs struct {
+	header  *pingSessionHeader
+	outputs []*pingOutput
+}
+
+// newPingOutputs creates <base>.txt, <base>.jsonl and/or <base>.csv in directory
+func newPingOutputs(directory, base string, formats []string) (*pingOutputs, error) {
+	outputs := &pingOutputs{outputs: make([]*pingOutput, 0, len(formats))}
+	for _, format := range formats {
+		var ext string
+		switch format {
+		case PingFormatText:
+			ext = "txt"
+		case PingFormatJSONL:
+			ext = "jsonl"
+		case PingFormatCSV:
+			ext = "csv"
+		default:
+			outputs.close()
+			return nil, fmt.Errorf("unknown ping output format %q", format)
+		}
+
+		filename := fmt.Sprintf("%s.%s", base, ext)
+		f, err := os.Create(path.Join(directory, filename))
+		if err != nil {
+			outputs.close()
+			return nil, fmt.Errorf("error creating ping output file %s: %w", filename, err)
+		}
+		o := &pingOutput{filename: filename, f: f, buf: bufio.NewWriter(f)}
+		switch format {
+		case PingFormatText:
+			o.writer = NewPingTextWriter(o.buf)
+		case PingFormatJSONL:
+			o.writer = NewPingJSONLWriter(o.buf)
+		case PingFormatCSV:
+			o.writer = NewPingCSVWriter(o.buf)
+		}
+		outputs.outputs = append(outputs.outputs, o)
+	}
+	return outputs, nil
+}
+
+func (p *pingOutputs) WriteHeader(prober *ICMPProber, terminal, pop string) error {
+	p.header = newPingSessionHeader(prober, terminal, pop)
+
+	var errs []error
+	for _, o := range p.outputs {
+		if err := o.writer.WriteHeader(p.header); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.filename, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *pingOutputs) WriteResult(r *ProbeResult) error {
+	var errs []error
+	for _, o := range p.outputs {
+		if err := o.writer.WriteResult(r); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.filename, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *pingOutputs) WriteFooter(stats *ProbeStats) error {
+	var errs []error
+	for _, o := range p.outputs {
+		if err := o.writer.WriteFooter(p.header, stats); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.filename, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// close flushes and closes every output file
+func (p *pingOutputs) close() error {
+	var errs []error
+	for _, o := range p.outputs {
+		if err := o.buf.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.filename, err))
+		}
+		if err := o.f.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.filename, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *pingOutputs) filenames() []string {
+	names := make([]string, 0, len(p.outputs))
+	for _, o := range p.outputs {
+		names = append(names, o.filename)
+	}
+	return names
+}
+
+// parsePingFormats parses a comma separated list such as "text,jsonl"
+func parsePingFormats(s string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		switch f {
+		case PingFormatText, PingFormatJSONL, PingFormatCSV:
+		default:
+			return nil, fmt.Errorf("unknown ping output format %q", f)
+		}
+		if !slices.Contains(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("no ping output format configured")
+	}
+	return formats, nil
+}
+
+func unixMicroString(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// pingRTTString mimics the precision iputils uses when printing round-trip times
+func pingRTTString(rtt time.Duration) string {
+	us := rtt.Microseconds()
+	switch {
+	case us >= 100000-50:
+		return fmt.Sprintf("%d", (us+500)/1000)
+	case us >= 10000-5:
+		return fmt.Sprintf("%d.%01d", (us+50)/1000, ((us+50)%1000)/100)
+	case us >= 1000:
+		return fmt.Sprintf("%d.%02d", (us+5)/1000, ((us+5)%1000)/10)
+	default:
+		return fmt.Sprintf("%d.%03d", us/1000, us%1000)
+	}
+}
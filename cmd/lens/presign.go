@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/phuslu/log"
+)
+
+const (
+	// presignChunkSize is the size of the chunks sent to a resumable URL that does not ask for another size
+	presignChunkSize = 8 << 20
+	// statusResumeIncomplete is the answer of a resumable URL to a chunk that did not complete the file
+	statusResumeIncomplete = http.StatusPermanentRedirect
+)
+
+// presignRequest is sent to the presign endpoint for every file
+type presignRequest struct {
+	Client   string `json:"client"`
+	Key      string `json:"key"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// presignResponse is the short-lived URL the file is PUT to,
+// with headers that have to be sent along, e.g. a checksum the URL was signed with.
+// A resumable URL takes the file in chunks with a Content-Range header, and answers every chunk that
+// did not complete the file with 308 and the bytes it received so far in a Range header, bytes=0-<last>.
+// A PUT without body and with Content-Range: bytes */<size> asks it for the bytes it received,
+// so that a failed upload continues where it stopped instead of sending the whole file again.
+type presignResponse struct {
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	Resumable bool              `json:"resumable,omitempty"`
+	ChunkSize int64             `json:"chunk_size,omitempty"`
+}
+
+// PresignUploader asks an HTTP endpoint, e.g. a Cloudflare Worker in front of R2,
+// for a presigned URL for every file and PUTs the file to it,
+// so that contributors do not need object store credentials.
+type PresignUploader struct {
+	endpoint string
+	token    string
+	client   *retryablehttp.Client
+}
+
+func NewPresignUploader(endpoint, token string) *PresignUploader {
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = uploadTimeout
+	client.RetryMax = 5
+	return &PresignUploader{
+		endpoint: endpoint,
+		token:    token,
+		client:   client,
+	}
+}
+
+func (u *PresignUploader) String() string {
+	return "presign endpoint " + u.endpoint
+}
+
+// Check sends a GET with the token to the endpoint, which answers with 2xx when the token is valid,
+// as the endpoint does not offer a presign request without a file
+func (u *PresignUploader) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	u.authorize(req.Header)
+	resp, err := u.client.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach presign endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("presign endpoint answered %s%s", resp.Status, responseMessage(resp.Body))
+	}
+	return nil
+}
+
+func (u *PresignUploader) authorize(h http.Header) {
+	if u.token != "" {
+		h.Set("Authorization", "Bearer "+u.token)
+	}
+}
+
+// responseMessage returns the start of an error response, to be appended to an error
+func responseMessage(body io.Reader) string {
+	msg, err := io.ReadAll(io.LimitReader(body, 1024))
+	if err != nil || len(bytes.TrimSpace(msg)) == 0 {
+		return ""
+	}
+	return ": " + string(bytes.TrimSpace(msg))
+}
+
+func (u *PresignUploader) Upload(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file %s: %w", localPath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to calculate SHA256 checksum for %s: %w", localPath, err)
+	}
+	request := presignRequest{
+		Client:   ClientName,
+		Key:      key,
+		Filename: path.Base(localPath),
+		Size:     size,
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	// a URL that expired while the upload was retried is requested again once
+	for attempt := 0; ; attempt++ {
+		presigned, err := u.presign(ctx, request)
+		if err != nil {
+			return err
+		}
+		put := u.put
+		if presigned.Resumable && size > 0 {
+			put = u.putResumable
+		}
+		status, err := put(ctx, presigned, file, size)
+		if err != nil {
+			return fmt.Errorf("failed to upload file %s: %w", localPath, err)
+		}
+		if status == http.StatusForbidden && attempt == 0 {
+			continue
+		}
+		if status < 200 || status > 299 {
+			return fmt.Errorf("failed to upload file %s: HTTP %d", localPath, status)
+		}
+		return nil
+	}
+}
+
+func (u *PresignUploader) presign(ctx context.Context, request presignRequest) (*presignResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, u.endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	u.authorize(req.Header)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request presigned URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("presign endpoint answered %s%s", resp.Status, responseMessage(resp.Body))
+	}
+	var presigned presignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&presigned); err != nil {
+		return nil, fmt.Errorf("failed to decode presign response: %w", err)
+	}
+	if presigned.URL == "" {
+		return nil, errors.New("presign response contains no URL")
+	}
+	return &presigned, nil
+}
+
+// put sends the file to the presigned URL and returns the HTTP status,
+// failed connections and server errors are retried with the whole file
+func (u *PresignUploader) put(ctx context.Context, presigned *presignResponse, file *os.File, size int64) (int, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPut, presigned.URL, io.ReadSeeker(file))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range presigned.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+// putResumable sends the file in chunks to a resumable URL and returns the HTTP status of the last chunk.
+// Every attempt first asks the URL for the bytes it received, e.g. before a chunk failed or lens restarted,
+// and continues from there. Like put, failed connections and server errors are retried up to RetryMax times.
+func (u *PresignUploader) putResumable(ctx context.Context, presigned *presignResponse, file *os.File, size int64) (int, error) {
+	for failures := 0; ; failures++ {
+		// a chunk without body asks for the received bytes
+		status, offset, err := u.putChunk(ctx, presigned, file, 0, 0, size)
+		if err == nil && status == statusResumeIncomplete {
+			if offset > 0 {
+				log.Info().Msgf("Resuming upload to %s at byte %d of %d", presigned.URL, offset, size)
+			}
+			status, err = u.putChunks(ctx, presigned, file, offset, size)
+		}
+		if err == nil && status < 500 {
+			return status, nil
+		}
+
+		if failures == u.client.RetryMax {
+			if err != nil {
+				return 0, err
+			}
+			return status, nil
+		}
+		wait := u.client.Backoff(u.client.RetryWaitMin, u.client.RetryWaitMax, failures, nil)
+		log.Debug().Err(err).Msgf("Upload to %s failed with status %d, retrying in %s", presigned.URL, status, wait)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// putChunks sends the file from offset, until the URL answers a chunk with anything but 308
+func (u *PresignUploader) putChunks(ctx context.Context, presigned *presignResponse, file *os.File, offset, size int64) (int, error) {
+	chunkSize := cmp.Or(presigned.ChunkSize, presignChunkSize)
+	for {
+		status, received, err := u.putChunk(ctx, presigned, file, offset, min(chunkSize, size-offset), size)
+		if err != nil || status != statusResumeIncomplete {
+			return status, err
+		}
+		if received <= offset {
+			return status, fmt.Errorf("%s received none of bytes %d-%d", presigned.URL, offset, size-1)
+		}
+		offset = received
+	}
+}
+
+// putChunk sends n bytes of the file from offset, or asks for the received bytes when n is 0,
+// and returns the HTTP status and, with 308, the number of bytes the URL received
+func (u *PresignUploader) putChunk(ctx context.Context, presigned *presignResponse, file *os.File,
+	offset, n, size int64) (status int, received int64, err error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if n > 0 {
+		body = io.NewSectionReader(file, offset, n)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presigned.URL, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", contentRange)
+	for k, v := range presigned.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := u.client.HTTPClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, 0, err
+	}
+	if resp.StatusCode == statusResumeIncomplete {
+		received, err = parseReceived(resp.Header.Get("Range"))
+		if err != nil {
+			return 0, 0, err
+		}
+		if received > size {
+			return 0, 0, fmt.Errorf("%s received %d bytes of %d", presigned.URL, received, size)
+		}
+	}
+	return resp.StatusCode, received, nil
+}
+
+// parseReceived returns the number of bytes in a Range header of the form bytes=0-<last>, 0 without header
+func parseReceived(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	last, ok := strings.CutPrefix(header, "bytes=0-")
+	if !ok {
+		return 0, fmt.Errorf("invalid Range header %q", header)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Range header %q: %w", header, err)
+	}
+	return n + 1, nil
+}
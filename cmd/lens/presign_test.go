@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// presignStandIn is a presign endpoint with an object store behind it. Resumable URLs
+// follow the protocol of presignResponse, and failChunk answers the chunk starting at
+// that offset once with 503, without keeping its bytes.
+type presignStandIn struct {
+	t         *testing.T
+	token     string
+	resumable bool
+	chunkSize int64
+	failChunk int64
+	// expire answers the first PUT with 403, like a URL that expired
+	expire bool
+
+	mu        sync.Mutex
+	presigned int
+	received  int64
+	objects   map[string][]byte
+	requests  map[string]presignRequest
+}
+
+func newPresignStandIn(t *testing.T) (*presignStandIn, *httptest.Server) {
+	s := &presignStandIn{
+		t:         t,
+		token:     "secret",
+		failChunk: -1,
+		objects:   make(map[string][]byte),
+		requests:  make(map[string]presignRequest),
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *presignStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/presign":
+		s.presign(w, r)
+	case strings.HasPrefix(r.URL.Path, "/objects/") && r.Method == http.MethodPut:
+		s.put(w, r, strings.TrimPrefix(r.URL.Path, "/objects/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *presignStandIn) presign(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		return
+	}
+	var req presignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.presigned++
+	s.requests[req.Key] = req
+	if err := json.NewEncoder(w).Encode(presignResponse{
+		URL:       fmt.Sprintf("http://%s/objects/%s", r.Host, req.Key),
+		Headers:   map[string]string{"X-Checksum-Sha256": req.SHA256},
+		Resumable: s.resumable,
+		ChunkSize: s.chunkSize,
+	}); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func (s *presignStandIn) put(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.received += int64(len(body))
+	if s.expire {
+		s.expire = false
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	req := s.requests[key]
+	if r.Header.Get("X-Checksum-Sha256") != req.SHA256 {
+		http.Error(w, "checksum header missing", http.StatusBadRequest)
+		return
+	}
+
+	if !s.resumable {
+		s.objects[key] = body
+		s.complete(w, key)
+		return
+	}
+
+	// Content-Range: bytes <first>-<last>/<size> or bytes */<size>
+	contentRange := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	chunk, _, _ := strings.Cut(contentRange, "/")
+	if chunk != "*" {
+		first, _, _ := strings.Cut(chunk, "-")
+		offset, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || offset != int64(len(s.objects[key])) {
+			http.Error(w, "unexpected Content-Range "+contentRange, http.StatusBadRequest)
+			return
+		}
+		if offset == s.failChunk {
+			s.failChunk = -1
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.objects[key] = append(s.objects[key], body...)
+	}
+	if int64(len(s.objects[key])) == req.Size {
+		s.complete(w, key)
+		return
+	}
+	if n := len(s.objects[key]); n > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	}
+	w.WriteHeader(statusResumeIncomplete)
+}
+
+func (s *presignStandIn) complete(w http.ResponseWriter, key string) {
+	sum := sha256.Sum256(s.objects[key])
+	if hex.EncodeToString(sum[:]) != s.requests[key].SHA256 {
+		http.Error(w, "checksum mismatch", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestPresignUploader(endpoint, token string) *PresignUploader {
+	u := NewPresignUploader(endpoint, token)
+	u.client.Logger = nil
+	u.client.RetryWaitMin = time.Millisecond
+	u.client.RetryWaitMax = 10 * time.Millisecond
+	return u
+}
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "ping-test.txt.zst")
+	if err := os.WriteFile(filename, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename, b
+}
+
+func TestPresignUpload(t *testing.T) {
+	const size = 10_000
+	tests := []struct {
+		name      string
+		resumable bool
+		failChunk int64
+		expire    bool
+		// presigned is the number of presign requests, received the number of bytes PUT
+		presigned int
+		received  int64
+	}{
+		{name: "single PUT", presigned: 1, received: size},
+		{name: "expired URL", expire: true, presigned: 2, received: 2 * size},
+		{name: "resumable", resumable: true, failChunk: -1, presigned: 1, received: size},
+		{name: "resumed after failed chunk", resumable: true, failChunk: 6000, presigned: 1, received: size + 2000},
+		{name: "resumable expired URL", resumable: true, failChunk: -1, expire: true, presigned: 2, received: size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standIn, server := newPresignStandIn(t)
+			standIn.resumable = tt.resumable
+			standIn.chunkSize = 2000
+			standIn.failChunk = tt.failChunk
+			standIn.expire = tt.expire
+			filename, b := writeTestFile(t, size)
+
+			u := newTestPresignUploader(server.URL+"/presign", standIn.token)
+			key := "client/ping/2025/03/2025-03-19/ping-test.txt.zst"
+			if err := u.Upload(context.Background(), filename, key); err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+
+			standIn.mu.Lock()
+			defer standIn.mu.Unlock()
+			if !bytes.Equal(standIn.objects[key], b) {
+				t.Errorf("stored object has %d bytes, want the %d bytes of the file", len(standIn.objects[key]), len(b))
+			}
+			if req := standIn.requests[key]; req.Size != size || req.Filename != filepath.Base(filename) {
+				t.Errorf("presign request = %+v", req)
+			}
+			if standIn.presigned != tt.presigned {
+				t.Errorf("presign requests = %d, want %d", standIn.presigned, tt.presigned)
+			}
+			if standIn.received != tt.received {
+				t.Errorf("received %d bytes, want %d", standIn.received, tt.received)
+			}
+		})
+	}
+}
+
+func TestPresignUploadResumesEarlierUpload(t *testing.T) {
+	const size = 10_000
+	standIn, server := newPresignStandIn(t)
+	standIn.resumable = true
+	standIn.chunkSize = 2000
+	filename, b := writeTestFile(t, size)
+
+	// the first 4000 bytes were received before lens restarted
+	key := "client/ping/2025/03/2025-03-19/ping-test.txt.zst"
+	standIn.objects[key] = bytes.Clone(b[:4000])
+
+	u := newTestPresignUploader(server.URL+"/presign", standIn.token)
+	if err := u.Upload(context.Background(), filename, key); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if !bytes.Equal(standIn.objects[key], b) {
+		t.Errorf("stored object has %d bytes, want the %d bytes of the file", len(standIn.objects[key]), len(b))
+	}
+	if standIn.received != size-4000 {
+		t.Errorf("received %d bytes, want %d", standIn.received, size-4000)
+	}
+}
+
+func TestPresignUploadFails(t *testing.T) {
+	standIn, server := newPresignStandIn(t)
+	filename, _ := writeTestFile(t, 100)
+
+	u := newTestPresignUploader(server.URL+"/presign", "wrong")
+	if err := u.Upload(context.Background(), filename, "client/ping/file"); err == nil {
+		t.Error("Upload() with an invalid token succeeded")
+	}
+
+	standIn.resumable = true
+	standIn.failChunk = 0
+	u = newTestPresignUploader(server.URL+"/presign", standIn.token)
+	u.client.RetryMax = 0
+	if err := u.Upload(context.Background(), filename, "client/ping/file"); err == nil {
+		t.Error("Upload() with a failed chunk and no retries succeeded")
+	}
+}
+
+func TestPresignCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid token", path: "/presign", token: "secret"},
+		{name: "invalid token", path: "/presign", token: "wrong", wantErr: true},
+		{name: "no token", path: "/presign", wantErr: true},
+		{name: "wrong path", path: "/missing", token: "secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := newPresignStandIn(t)
+			u := newTestPresignUploader(server.URL+tt.path, tt.token)
+			if err := u.Check(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	if err := newTestPresignUploader(server.URL, "secret").Check(context.Background()); err == nil {
+		t.Error("Check() of an endpoint answering 500 succeeded")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// Recorder appends timestamped JSON records, one per line, to
+// <DataDir>/<date>/<name>-<datetime>.jsonl. When the rotation period is over,
+// the finished file is compressed and uploaded like a ping result under kind,
+// also when no record follows.
+type Recorder struct {
+	kind   string
+	name   string
+	period time.Duration
+
+	// onRotate, if set, is called with each finished file before it is compressed
+	// and returns derived files that are compressed and uploaded along with it
+	onRotate func(directory, filename string) []string
+
+	mu       sync.Mutex
+	f        *os.File
+	today    string
+	filename string
+	window   time.Time
+	timer    *time.Timer
+}
+
+// recorders are all recorders, whose files left by a previous run are finalized at startup
+var recorders []*Recorder
+
+// NewRecorder creates a recorder for the records of kind, with file names tagged by terminal t
+func NewRecorder(kind string, t *Terminal, period time.Duration) *Recorder {
+	r := &Recorder{
+		kind:   kind,
+		name:   t.name(kind),
+		period: period,
+	}
+	recorders = append(recorders, r)
+	return r
+}
+
+// Write appends v as a single JSON line, rotating the file first if needed
+func (r *Recorder) Write(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error marshalling %s record: %w", r.kind, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	if r.f != nil && !now.Truncate(r.period).Equal(r.window) {
+		r.rotateLocked()
+	}
+	if r.f == nil {
+		r.today = checkDirectory()
+		r.filename = fmt.Sprintf("%s-%s.jsonl", r.name, datetimeString())
+		r.window = now.Truncate(r.period)
+		r.f, err = os.OpenFile(path.Join(DataDir, r.today, r.filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			r.f = nil
+			return fmt.Errorf("error creating %s file: %w", r.kind, err)
+		}
+		window := r.window
+		r.timer = time.AfterFunc(window.Add(r.period).Sub(now), func() {
+			r.rotateAtEnd(window)
+		})
+	}
+
+	b = append(b, '\n')
+	if _, err := r.f.Write(b); err != nil {
+		return fmt.Errorf("error writing %s file %s: %w", r.kind, r.filename, err)
+	}
+	return nil
+}
+
+// rotateAtEnd rotates the file of window once its period is over
+func (r *Recorder) rotateAtEnd(window time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil || !r.window.Equal(window) {
+		// the file was rotated by Write already
+		return
+	}
+	if now := time.Now().UTC(); now.Truncate(r.period).Equal(window) {
+		// the clock was set back
+		r.timer = time.AfterFunc(window.Add(r.period).Sub(now), func() {
+			r.rotateAtEnd(window)
+		})
+		return
+	}
+	r.rotateLocked()
+}
+
+func (r *Recorder) rotateLocked() {
+	if r.f == nil {
+		return
+	}
+	r.timer.Stop()
+	if err := r.f.Close(); err != nil {
+		log.Error().Err(err).Msgf("Error closing %s file %s", r.kind, r.filename)
+	}
+	r.f = nil
+
+	go r.finalize(path.Join(DataDir, r.today), r.filename)
+}
+
+func (r *Recorder) finalize(directory, filename string) {
+	filenames := []string{filename}
+	if r.onRotate != nil {
+		filenames = append(filenames, r.onRotate(directory, filename)...)
+	}
+
+	for _, filename := range filenames {
+		fullFilename, err := compress(directory, filename)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error compressing %s file", r.kind)
+			continue
+		}
+		uploadResult(r.kind, fullFilename, nil)
+	}
+}
+
+// leftovers returns the files a previous run left open, e.g. when lens was stopped, in the order they were written
+func (r *Recorder) leftovers() []string {
+	filenames, err := filepath.Glob(path.Join(DataDir, "*", r.name+"-*.jsonl"))
+	if err != nil {
+		log.Error().Err(err).Msgf("Error listing %s files", r.kind)
+		return nil
+	}
+
+	r.mu.Lock()
+	current := ""
+	if r.f != nil {
+		current = path.Join(DataDir, r.today, r.filename)
+	}
+	r.mu.Unlock()
+
+	var leftovers []string
+	for _, filename := range filenames {
+		// only <name>-<datetime>.jsonl, not the files of another terminal whose name starts with name
+		datetime := strings.TrimSuffix(strings.TrimPrefix(path.Base(filename), r.name+"-"), ".jsonl")
+		if _, err := time.Parse(datetimeFormat, datetime); err != nil || filename == current {
+			continue
+		}
+		leftovers = append(leftovers, filename)
+	}
+	// the date directories and datetimes sort chronologically
+	return leftovers
+}
+
+// finalizeLeftovers compresses and uploads the files a previous run left open
+func (r *Recorder) finalizeLeftovers() {
+	for _, filename := range r.leftovers() {
+		log.Info().Msgf("Finalizing %s file %s left by a previous run", r.kind, filename)
+		go r.finalize(path.Dir(filename), path.Base(filename))
+	}
+}
+
+// finalizeRecorders finalizes the files all recorders left in a previous run
+func finalizeRecorders() {
+	for _, r := range recorders {
+		r.finalizeLeftovers()
+	}
+}
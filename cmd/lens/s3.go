@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Uploader uploads to an S3 compatible bucket, e.g. AWS S3, MinIO, Cloudflare R2 or Backblaze B2.
+// Files larger than partSize are uploaded in parts, and every part is sent with its MD5 checksum,
+// which the object store verifies before accepting it.
+type S3Uploader struct {
+	client   *minio.Client
+	endpoint string
+	bucket   string
+	partSize uint64
+}
+
+func NewS3Uploader(endpoint, region, bucket, accessKey, secretKey string, secure, pathStyle bool, partSize uint64) (*S3Uploader, error) {
+	lookup := minio.BucketLookupAuto
+	if pathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:       secure,
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	return &S3Uploader{
+		client:   client,
+		endpoint: endpoint,
+		bucket:   bucket,
+		partSize: partSize,
+	}, nil
+}
+
+func (u *S3Uploader) String() string {
+	return fmt.Sprintf("S3 bucket %s at %s", u.bucket, u.endpoint)
+}
+
+func (u *S3Uploader) Check(ctx context.Context) error {
+	exists, err := u.client.BucketExists(ctx, u.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to access S3 bucket %s: %w", u.bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", u.bucket)
+	}
+	return nil
+}
+
+func (u *S3Uploader) Upload(ctx context.Context, localPath, key string) error {
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat local file %s: %w", localPath, err)
+	}
+
+	info, err := u.client.FPutObject(ctx, u.bucket, key, localPath, minio.PutObjectOptions{
+		PartSize:       u.partSize,
+		SendContentMd5: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file %s to S3: %w", localPath, err)
+	}
+	if info.Size != stat.Size() {
+		return fmt.Errorf("size of uploaded object %s does not match %s (%d != %d)", key, localPath, info.Size, stat.Size())
+	}
+	return nil
+}
+
+func (u *S3Uploader) List(ctx context.Context, prefix string) (map[string]int64, error) {
+	objects := make(map[string]int64)
+	for obj := range u.client.ListObjects(ctx, u.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list S3 bucket %s: %w", u.bucket, obj.Err)
+		}
+		objects[obj.Key] = obj.Size
+	}
+	return objects, nil
+}
+
+func (u *S3Uploader) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return u.client.GetObject(ctx, u.bucket, key, minio.GetObjectOptions{})
+}
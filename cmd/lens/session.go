@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// SessionMeta is written as <session>.meta.json and bundled into the archive of every measurement session,
+// so that the context of the results does not have to be guessed from file names
+type SessionMeta struct {
+	Version      string    `json:"lens_version"`
+	Client       string    `json:"client"`
+	Terminal     string    `json:"terminal,omitempty"`
+	Iface        string    `json:"iface"`
+	IPVersion    int       `json:"ip_version"`
+	ExternalIPv4 string    `json:"external_ipv4,omitempty"`
+	ExternalIPv6 string    `json:"external_ipv6,omitempty"`
+	Gateway      string    `json:"gateway"`
+	PoP          string    `json:"pop"`
+	City         string    `json:"city,omitempty"`
+	Dish         *DishInfo `json:"dish,omitempty"`
+
+	Kind   string `json:"kind"`
+	Target string `json:"target,omitempty"`
+	// TargetAddr is the address Target was resolved to when the session started
+	TargetAddr string `json:"target_addr,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	// ExitStatus follows ping and irtt: 0 on success, 1 when no reply was received, 2 or the exit code of irtt on errors
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error,omitempty"`
+	// Interrupted lists the network events that ended the session early, see NetworkEvent
+	Interrupted string `json:"interrupted,omitempty"`
+
+	StartLocation *LocationFix   `json:"start_location,omitempty"`
+	EndLocation   *LocationFix   `json:"end_location,omitempty"`
+	Outages       []OutageRecord `json:"outages"`
+
+	start    time.Time
+	terminal *Terminal
+}
+
+// DishInfo identifies the dish a session was measured with
+type DishInfo struct {
+	ID              string `json:"id"`
+	HardwareVersion string `json:"hardware_version"`
+	SoftwareVersion string `json:"software_version"`
+}
+
+// newSessionMeta is called when a session starts. The start and end locations are the last fixes
+// of the location collector, so that concurrent sessions do not all query the dish, see LocationTracker.Prefetch.
+func (t *Terminal) newSessionMeta(kind, target string) *SessionMeta {
+	start := time.Now()
+
+	t.mu.Lock()
+	m := &SessionMeta{
+		Version:      version,
+		Client:       ClientName,
+		Terminal:     t.ID,
+		Iface:        t.Iface,
+		IPVersion:    t.ipVersion,
+		ExternalIPv4: t.externalIPv4,
+		ExternalIPv6: t.externalIPv6,
+		Gateway:      t.gateway,
+		PoP:          t.pop,
+		City:         t.city,
+		Kind:         kind,
+		Target:       target,
+		Start:        start.UTC().Format(time.RFC3339Nano),
+		start:        start,
+		terminal:     t,
+	}
+	t.mu.Unlock()
+
+	if exporter, err := t.dish.Get(); err == nil {
+		m.Dish = &DishInfo{
+			ID:              exporter.DishID,
+			HardwareVersion: exporter.HardwareVersion,
+			SoftwareVersion: exporter.SoftwareVersion,
+		}
+	}
+	m.StartLocation = t.location.Last()
+	return m
+}
+
+// finish is called when a session ends with its exit status and error, if any,
+// and annotates it with the dish outages that overlapped it. The outages are those the
+// collectors already recorded, so that concurrent sessions do not all query the dish when they end.
+func (m *SessionMeta) finish(exitStatus int, err error) {
+	end := time.Now()
+	m.End = end.UTC().Format(time.RFC3339Nano)
+	m.ExitStatus = exitStatus
+	if err != nil {
+		m.Error = err.Error()
+	}
+	m.EndLocation = m.terminal.location.Last()
+
+	m.Outages = m.terminal.outages.Between(m.start, end)
+	if m.Outages == nil {
+		m.Outages = []OutageRecord{}
+	}
+}
+
+// write stores the metadata as <base>.meta.json in directory and returns the file name
+func (m *SessionMeta) write(directory, base string) (string, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshalling session metadata: %w", err)
+	}
+	filename := base + ".meta.json"
+	if err := os.WriteFile(path.Join(directory, filename), b, 0644); err != nil {
+		return "", fmt.Errorf("error writing session metadata %s: %w", filename, err)
+	}
+	return filename, nil
+}
+
+// archive writes the metadata next to the output files of the session in directory,
+// bundles it into the archive of every output file and queues the archives for upload.
+// Without tar archives, the metadata is compressed and uploaded as a separate file.
+func (m *SessionMeta) archive(directory, base string, filenames []string) {
+	metaFilename, err := m.write(directory, base)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error writing %s session metadata", m.Kind)
+	}
+
+	var bundle []string
+	if metaFilename != "" && CompressionTar {
+		bundle = []string{metaFilename}
+	}
+	bundled := false
+	for _, filename := range filenames {
+		if len(bundle) == 0 && isCompressed(filename) {
+			uploadResult(m.Kind, path.Join(directory, filename), m)
+			continue
+		}
+		fullFilename, err := compress(directory, filename, bundle...)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error compressing %s output file", m.Kind)
+			continue
+		}
+		bundled = bundled || len(bundle) > 0
+		uploadResult(m.Kind, fullFilename, m)
+	}
+
+	if metaFilename == "" {
+		return
+	}
+	if bundled {
+		if err := os.Remove(path.Join(directory, metaFilename)); err != nil {
+			log.Error().Err(err).Msgf("Error removing %s", metaFilename)
+		}
+		return
+	}
+	fullFilename, err := compress(directory, metaFilename)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error compressing %s session metadata", m.Kind)
+		return
+	}
+	uploadResult(m.Kind, fullFilename, m)
+}
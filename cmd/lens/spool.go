@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	spoolRetryMin   = 30 * time.Second
+	spoolRetryMax   = time.Hour
+	spoolTmpSuffix  = ".part"
+	uploadTimeout   = 30 * time.Minute
+	spoolFlushEvery = time.Minute
+)
+
+type spoolEntry struct {
+	attempts int
+	next     time.Time
+}
+
+// UploadSpool is a persistent upload queue. Result files are moved into the spool directory
+// under their object key, and only removed after the uploader verified the upload.
+// Failed uploads are retried with exponential backoff, also across restarts.
+type UploadSpool struct {
+	dir      string
+	uploader Uploader
+
+	mu      sync.Mutex
+	pending map[string]*spoolEntry
+}
+
+// spool is the upload queue of the configured upload backend, nil when uploads are disabled
+var spool *UploadSpool
+
+// NewUploadSpool creates the spool directory and queues the files left in it by a previous run
+func NewUploadSpool(dir string, uploader Uploader) (*UploadSpool, error) {
+	dir = path.Clean(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating spool directory %s: %w", dir, err)
+	}
+	s := &UploadSpool{
+		dir:      dir,
+		uploader: uploader,
+		pending:  make(map[string]*spoolEntry),
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(p, spoolTmpSuffix) {
+			// an interrupted move, the original file is still in place
+			return os.Remove(p)
+		}
+		key, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		s.pending[filepath.ToSlash(key)] = &spoolEntry{}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory %s: %w", dir, err)
+	}
+	if len(s.pending) > 0 {
+		log.Info().Msgf("%d files left in upload spool %s", len(s.pending), dir)
+	}
+	s.observe()
+	return s, nil
+}
+
+// Enqueue moves a local file into the spool to be uploaded as key
+func (s *UploadSpool) Enqueue(localFilename, key string) error {
+	spooled := path.Join(s.dir, key)
+	if err := os.MkdirAll(path.Dir(spooled), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(localFilename, spooled); err != nil {
+		return fmt.Errorf("error moving %s into upload spool: %w", localFilename, err)
+	}
+
+	s.mu.Lock()
+	s.pending[key] = &spoolEntry{}
+	s.mu.Unlock()
+	s.observe()
+	return nil
+}
+
+// moveFile renames src to dst, or copies it when they are on different file systems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + spoolTmpSuffix
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// due returns the keys whose next attempt is due
+func (s *UploadSpool) due() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(s.pending))
+	for key, e := range s.pending {
+		if !e.next.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Flush uploads all files whose next attempt is due
+func (s *UploadSpool) Flush() {
+	for _, key := range s.due() {
+		s.upload(key)
+	}
+	// the manifests of the days before today wait for the uploads of their files
+	if manifests != nil {
+		manifests.Finalize()
+	}
+	s.observe()
+}
+
+func (s *UploadSpool) upload(key string) {
+	spooled := path.Join(s.dir, key)
+	info, err := os.Stat(spooled)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("%s disappeared from the upload spool", spooled)
+		s.done(key)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+
+	log.Info().Msgf("Uploading %s to %s: %s", spooled, s.uploader, key)
+	if err := s.uploader.Upload(ctx, spooled, key); err != nil {
+		metrics.Add("lens_uploads_total", 1, "result", "failure")
+		next := s.retry(key)
+		log.Error().Err(err).Msgf("Error uploading %s to %s, retrying in %s", spooled, s.uploader, next)
+		return
+	}
+	metrics.Add("lens_uploads_total", 1, "result", "success")
+	if info != nil {
+		metrics.Add("lens_upload_bytes_total", float64(info.Size()))
+	}
+	if manifests != nil {
+		if err := manifests.MarkUploaded(key); err != nil {
+			log.Error().Err(err).Msgf("Error recording the upload of %s in the manifest", key)
+		}
+	}
+
+	if err := os.Remove(spooled); err != nil {
+		log.Error().Err(err).Msgf("Error removing uploaded file %s", spooled)
+	}
+	// remove the directories of the key once they are empty
+	for dir := path.Dir(spooled); dir != s.dir && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	s.done(key)
+}
+
+// retry schedules the next attempt of key and returns the backoff
+func (s *UploadSpool) retry(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.pending[key]
+	if !ok {
+		return 0
+	}
+	backoff := spoolRetryMax
+	if e.attempts < 10 {
+		backoff = min(spoolRetryMin<<e.attempts, spoolRetryMax)
+	}
+	e.attempts++
+	e.next = time.Now().Add(backoff)
+	return backoff
+}
+
+// Pending reports whether key is queued for upload
+func (s *UploadSpool) Pending(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[key]
+	return ok
+}
+
+func (s *UploadSpool) done(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, key)
+}
+
+func (s *UploadSpool) observe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var size int64
+	for key := range s.pending {
+		if info, err := os.Stat(path.Join(s.dir, key)); err == nil {
+			size += info.Size()
+		}
+	}
+	metrics.Set("lens_upload_spool_files", float64(len(s.pending)))
+	metrics.Set("lens_upload_spool_bytes", float64(size))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/phuslu/log"
+)
+
+// DishStatusRecord is one line of a status-<datetime>.jsonl file
+type DishStatusRecord struct {
+	Timestamp string          `json:"timestamp"`
+	DishID    string          `json:"dish_id"`
+	Status    json.RawMessage `json:"status"`
+}
+
+// StatusCollector polls the dish GetStatus API and records every response
+type StatusCollector struct {
+	terminal *Terminal
+	dish     *DishClient
+	recorder *Recorder
+}
+
+func NewStatusCollector(t *Terminal) *StatusCollector {
+	return &StatusCollector{
+		terminal: t,
+		dish:     t.dish,
+		recorder: NewRecorder("status", t, time.Hour),
+	}
+}
+
+// Collect polls GetStatus once and appends the response to the status file
+func (s *StatusCollector) Collect() {
+	exporter, err := s.dish.Get()
+	if err != nil {
+		log.Error().Err(err).Msgf("Error creating gRPC client to Starlink dish%s", s.terminal.logSuffix())
+		return
+	}
+
+	now := time.Now().UTC()
+	status, err := exporter.CollectDishStatus()
+	if err != nil {
+		log.Error().Err(err).Msgf("Error collecting dish status%s", s.terminal.logSuffix())
+		metrics.Set("lens_dish_up", 0, "terminal", s.terminal.ID)
+		s.dish.Reset()
+		return
+	}
+
+	s.terminal.outages.ObserveStatus(status)
+	observeDishStatus(s.terminal.ID, status)
+
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(status)
+	if err != nil {
+		log.Error().Err(err).Msg("Error marshalling dish status")
+		return
+	}
+
+	if err := s.recorder.Write(&DishStatusRecord{
+		Timestamp: now.Format(time.RFC3339Nano),
+		DishID:    exporter.DishID,
+		Status:    b,
+	}); err != nil {
+		log.Error().Err(err).Msg("Error recording dish status")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	swift "github.com/ncw/swift/v2"
@@ -25,13 +26,27 @@ func NewSwiftConn(username, apiKey, authURL, domain, tenant string) (*swift.Conn
 	return &conn, nil
 }
 
-func TestSwiftConnection() error {
-	conn, err := NewSwiftConn(SwiftUsername, SwiftAPIKey, SwiftAuthURL, SwiftDomain, SwiftTenant)
+// SwiftUploader uploads to an OpenStack Swift container
+type SwiftUploader struct {
+	username  string
+	apiKey    string
+	authURL   string
+	domain    string
+	tenant    string
+	container string
+}
+
+func (u *SwiftUploader) String() string {
+	return "Swift container " + u.container
+}
+
+func (u *SwiftUploader) Check(ctx context.Context) error {
+	conn, err := NewSwiftConn(u.username, u.apiKey, u.authURL, u.domain, u.tenant)
 	if err != nil {
 		return err
 	}
 
-	containers, err := conn.ContainerNames(context.Background(), nil)
+	containers, err := conn.ContainerNames(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to list Swift containers: %w", err)
 	}
@@ -43,7 +58,15 @@ func TestSwiftConnection() error {
 	return nil
 }
 
-func UploadToSwift(conn *swift.Connection, containerName, localPath, targetPath string) error {
+func (u *SwiftUploader) Upload(ctx context.Context, localPath, key string) error {
+	conn, err := NewSwiftConn(u.username, u.apiKey, u.authURL, u.domain, u.tenant)
+	if err != nil {
+		return err
+	}
+	return UploadToSwift(ctx, conn, u.container, localPath, key)
+}
+
+func UploadToSwift(ctx context.Context, conn *swift.Connection, containerName, localPath, targetPath string) error {
 	if conn == nil {
 		return errors.New("swift connection is nil")
 	}
@@ -59,10 +82,38 @@ func UploadToSwift(conn *swift.Connection, containerName, localPath, targetPath
 		return fmt.Errorf("failed to calculate MD5 checksum for %s: %w", localPath, err)
 	}
 	log.Debug().Msgf("MD5 checksum of %s: %s", localPath, md5sum)
-	headers, err := conn.ObjectPut(context.Background(), containerName, targetPath, file, true, md5sum, "", nil)
+	headers, err := conn.ObjectPut(ctx, containerName, targetPath, file, true, md5sum, "", nil)
 	if err != nil {
 		return fmt.Errorf("failed to upload file %s to Swift: %w", localPath, err)
 	}
 	log.Debug().Msgf("Successfully uploaded %s to container %s as %s\nHeaders: %v\n", localPath, containerName, targetPath, headers)
 	return nil
 }
+
+func (u *SwiftUploader) List(ctx context.Context, prefix string) (map[string]int64, error) {
+	conn, err := NewSwiftConn(u.username, u.apiKey, u.authURL, u.domain, u.tenant)
+	if err != nil {
+		return nil, err
+	}
+	all, err := conn.ObjectsAll(ctx, u.container, &swift.ObjectsOpts{Prefix: prefix})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Swift container %s: %w", u.container, err)
+	}
+	objects := make(map[string]int64, len(all))
+	for _, obj := range all {
+		objects[obj.Name] = obj.Bytes
+	}
+	return objects, nil
+}
+
+func (u *SwiftUploader) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	conn, err := NewSwiftConn(u.username, u.apiKey, u.authURL, u.domain, u.tenant)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := conn.ObjectOpen(ctx, u.container, key, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	targetResolveAttempts = 3
+	targetResolveTimeout  = 10 * time.Second
+)
+
+// resolveTarget returns the address of a ping target host from the current discovery state,
+// so that every session probes what was detected last rather than what was detected at startup.
+// gatewayTarget is the detected gateway, popTarget the PoP anycast address, and names are resolved,
+// preferring addresses of the IP version of the terminal. Names are resolved again after a failure.
+func (t *Terminal) resolveTarget(host string) (net.IP, error) {
+	gateway, _, ipVersion := t.Gateway()
+	switch host {
+	case gatewayTarget:
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return nil, errors.New("gateway not detected")
+		}
+		return ip, nil
+	case popTarget:
+		host = popAnycastHost
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	var err error
+	for attempt := range targetResolveAttempts {
+		if attempt > 0 {
+			log.Warn().Err(err).Msgf("Error resolving ping target %s, resolving it again%s", host, t.logSuffix())
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var ip net.IP
+		if ip, err = lookupTarget(host, ipVersion); err == nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot resolve ping target %s: %w", host, err)
+}
+
+// lookupTarget resolves host, and returns an address of ipVersion if it has one
+func lookupTarget(host string, ipVersion int) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), targetResolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no address", host)
+	}
+	for _, ip := range addrs {
+		if ipVersion != 0 && (ip.To4() != nil) == (ipVersion == 4) {
+			return ip, nil
+		}
+	}
+	return addrs[0], nil
+}
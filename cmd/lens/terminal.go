@@ -0,0 +1,338 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/phuslu/log"
+)
+
+// Terminal is one Starlink terminal measured through one local interface.
+// Gateway detection, measurement sessions and dish collectors of each terminal
+// run independently, and every output file is tagged with the terminal ID.
+type Terminal struct {
+	ID             string
+	Iface          string
+	Active         bool
+	ManualGateway  string
+	IPv6GatewayHop int
+	RouterGrpc     string
+	Cron           string
+	IRTTLocalIP    string
+	PingTargets    []PingTarget
+
+	bindGrpc bool
+	dish     *DishClient
+	outages  *OutageTracker
+	location *LocationTracker
+	events   *Recorder
+
+	// detecting serializes scheduled detections and those after link changes
+	detecting sync.Mutex
+
+	mu        sync.Mutex
+	gateway   string
+	pop       string
+	city      string
+	ipVersion int
+	// externalIPv6 is the source address of IRTT sessions over IPv6
+	externalIPv6 string
+	externalIPv4 string
+	// known is compared with every detection for network events, which cancel sessions
+	known       networkState
+	sessions    context.Context
+	endSessions context.CancelCauseFunc
+	// linkUp is closed when the link comes up again, nil while it is up
+	linkUp chan struct{}
+	// addrs are the global addresses of the interface at the last detection, compared by CheckNetwork
+	addrs string
+}
+
+func NewTerminal(c TerminalConfig) *Terminal {
+	t := &Terminal{
+		ID:             c.ID,
+		Iface:          c.Iface,
+		Active:         c.Active != nil && *c.Active,
+		ManualGateway:  c.ManualGateway,
+		IPv6GatewayHop: c.IPv6GatewayHop,
+		RouterGrpc:     c.RouterGrpc,
+		Cron:           c.Cron,
+		IRTTLocalIP:    c.LocalIP,
+		PingTargets:    c.PingTargets,
+		bindGrpc:       c.bindGrpc,
+	}
+	t.dish = NewDishClient(c.DishGrpc, t.grpcIface())
+	t.events = NewRecorder("event", t, 24*time.Hour)
+	if EnableOutages {
+		t.outages = NewOutageTracker(t)
+	}
+	if EnableLocation {
+		t.location = NewLocationTracker(t)
+	}
+	return t
+}
+
+// name tags a file or job name with the terminal ID, e.g. "status" becomes "status-dish1".
+// Names are unchanged for the single terminal without ID.
+func (t *Terminal) name(kind string) string {
+	if t.ID == "" {
+		return kind
+	}
+	return kind + "-" + t.ID
+}
+
+// logSuffix is appended to log messages and errors to tell terminals apart
+func (t *Terminal) logSuffix() string {
+	if t.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (terminal %s)", t.ID)
+}
+
+func (t *Terminal) grpcIface() string {
+	if !t.bindGrpc {
+		return ""
+	}
+	return t.Iface
+}
+
+// Gateway returns the result of the last gateway detection
+func (t *Terminal) Gateway() (gateway, pop string, ipVersion int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.gateway, t.pop, t.ipVersion
+}
+
+// PoP returns the PoP of the last gateway detection. If it is unknown, e.g. because the GeoIP feed
+// was not available yet, the external address is looked up again in the current feed.
+// Sessions are tagged with unknownPoP while the PoP stays unknown.
+func (t *Terminal) PoP() string {
+	t.mu.Lock()
+	pop := t.pop
+	t.mu.Unlock()
+	if pop != "" {
+		return pop
+	}
+	return cmp.Or(t.lookupPoP(), unknownPoP)
+}
+
+// lookupPoP looks up the external address of the last detection in the current GeoIP feed,
+// which may map it to another PoP after an update, and returns the PoP
+func (t *Terminal) lookupPoP() string {
+	t.mu.Lock()
+	externalIP := t.externalIPv4
+	if t.ipVersion == 6 {
+		externalIP = t.externalIPv6
+	}
+	info, ok := geoipClient.GetPopByCIDR(externalIP)
+	if externalIP == "" || !ok || info.Pop == t.pop {
+		pop := t.pop
+		t.mu.Unlock()
+		return pop
+	}
+	t.pop, t.city = info.Pop, info.City
+	gateway, ipVersion := t.gateway, t.ipVersion
+	events := t.known.update(t.networkStateLocked())
+	t.mu.Unlock()
+
+	observeGateway(t.ID, gateway, info.Pop, ipVersion)
+	log.Info().Msgf("Starlink PoP: %s, external IP: %s%s", info.Pop, externalIP, t.logSuffix())
+	t.handleNetworkEvents(events)
+	return info.Pop
+}
+
+// DetectGateway detects the gateway and PoP of the terminal and returns the gateway
+func (t *Terminal) DetectGateway() string {
+	t.detecting.Lock()
+	defer t.detecting.Unlock()
+
+	addrs := t.globalAddrs()
+	gateway, externalIP, ipVersion := t.detectGateway()
+	var info PopInfo
+	if externalIP != "" {
+		var ok bool
+		if info, ok = geoipClient.GetPopByCIDR(externalIP); !ok {
+			log.Warn().Msgf("%s is not in the GeoIP feed%s", externalIP, t.logSuffix())
+		}
+	}
+	pop := info.Pop
+
+	// the external address of the other IP version is only recorded in the session metadata
+	externalIPv4, externalIPv6 := "", ""
+	switch ipVersion {
+	case 4:
+		externalIPv4 = externalIP
+		if t.Active && t.ManualGateway == "" {
+			if ip, err := externalIPs.Lookup(t.Iface, 6); err == nil && ip.Local {
+				externalIPv6 = ip.String()
+			}
+		}
+	case 6:
+		externalIPv6 = externalIP
+		if t.Active && t.ManualGateway == "" {
+			if ip, err := externalIPs.Lookup(t.Iface, 4); err == nil {
+				externalIPv4 = ip.String()
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.gateway = gateway
+	t.pop = pop
+	t.city = info.City
+	t.ipVersion = ipVersion
+	t.externalIPv4 = externalIPv4
+	t.externalIPv6 = externalIPv6
+	t.addrs = addrs
+	events := t.known.update(t.networkStateLocked())
+	t.mu.Unlock()
+
+	observeGateway(t.ID, gateway, pop, ipVersion)
+	log.Info().Msgf("Starlink gateway: %s, PoP: %s, external IP: %s%s", gateway, pop, externalIP, t.logSuffix())
+	t.handleNetworkEvents(events)
+	return gateway
+}
+
+// schedule adds the jobs of the terminal to s
+func (t *Terminal) schedule(s gocron.Scheduler) error {
+	_, err := s.NewJob(
+		gocron.DurationJob(
+			detectInterval,
+		),
+		gocron.NewTask(
+			t.DetectGateway,
+		),
+		gocron.WithName(t.name("get_gateway")),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating getGateway job: %w", err)
+	}
+
+	_, err = s.NewJob(
+		gocron.DurationJob(
+			eventsInterval,
+		),
+		gocron.NewTask(
+			t.CheckNetwork,
+		),
+		gocron.WithName(t.name("check_network")),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating check_network job: %w", err)
+	}
+
+	_, err = s.NewJob(
+		gocron.CronJob(
+			t.Cron,
+			false,
+		),
+		gocron.NewTask(
+			t.PingSession,
+		),
+		gocron.WithName(t.name("icmp_ping")),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating icmp_ping job: %w", err)
+	}
+
+	if EnableIRTT {
+		_, err = s.NewJob(
+			gocron.CronJob(
+				t.Cron,
+				false,
+			),
+			gocron.NewTask(
+				t.IRTTPing,
+			),
+			gocron.WithName(t.name("irtt_ping")),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating irtt_ping job: %w", err)
+		}
+	}
+
+	if EnableOutages && !EnableStatus && !EnableHistory {
+		_, err = s.NewJob(
+			gocron.DurationJob(
+				5*time.Minute,
+			),
+			gocron.NewTask(
+				t.outages.Poll,
+			),
+			gocron.WithName(t.name("dish_outage")),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating dish_outage job: %w", err)
+		}
+	}
+
+	if EnableLocation {
+		_, err = s.NewJob(
+			gocron.DurationJob(
+				locationInterval,
+			),
+			gocron.NewTask(
+				t.location.Collect,
+			),
+			gocron.WithName(t.name("dish_location")),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating dish_location job: %w", err)
+		}
+	}
+
+	if EnableStatus {
+		collector := NewStatusCollector(t)
+		_, err = s.NewJob(
+			gocron.DurationJob(
+				statusInterval,
+			),
+			gocron.NewTask(
+				collector.Collect,
+			),
+			gocron.WithName(t.name("dish_status")),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating dish_status job: %w", err)
+		}
+	}
+
+	if EnableHistory {
+		harvester := NewHistoryHarvester(t)
+		_, err = s.NewJob(
+			gocron.DurationJob(
+				historyInterval,
+			),
+			gocron.NewTask(
+				harvester.Harvest,
+			),
+			gocron.WithName(t.name("dish_history")),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+			gocron.WithStartAt(gocron.WithStartImmediately()),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating dish_history job: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Terminal) logConfig() {
+	gateway, pop, ipVersion := t.Gateway()
+	log.Info().Msgf("Terminal %s: IFACE %s, gateway %s, PoP %s, IPv%d, CRON %s",
+		cmp.Or(t.ID, "-"), t.Iface, gateway, pop, ipVersion, t.Cron)
+	for _, p := range t.PingTargets {
+		log.Info().Msgf("Ping target: %s, interval %s, duration %s%s", cmp.Or(p.Name, p.Host), p.Interval, p.Duration, t.logSuffix())
+	}
+}
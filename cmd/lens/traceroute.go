@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	traceBasePort  = 33434
+	traceMaxHops   = 30
+	traceProbes    = 3
+	traceProbeGap  = 10 * time.Millisecond
+	tracePayload   = 32
+	sizeofEEHeader = 16
+
+	// a send is repeated when it failed with the pending ICMP error of an earlier probe
+	traceSendAttempts = 3
+
+	icmpTimeExceeded      = 11
+	icmpUnreachable       = 3
+	icmpv6TimeExceeded    = 3
+	icmpv6Unreachable     = 1
+	icmpPortUnreachable   = 3
+	icmpv6PortUnreachable = 4
+)
+
+// Hop is one router on the path to a traceroute target.
+// Addr is empty when none of the probes with this TTL was answered.
+type Hop struct {
+	TTL  int
+	Addr string
+	Sent int
+	RTTs []time.Duration
+	// Reached is set when the target or a router answered that the target is unreachable
+	Reached bool
+}
+
+func (h Hop) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%2d  ", h.TTL)
+	if h.Addr == "" {
+		sb.WriteString("*")
+	} else {
+		sb.WriteString(h.Addr)
+	}
+	for _, rtt := range h.RTTs {
+		fmt.Fprintf(&sb, "  %.3f ms", float64(rtt.Microseconds())/1000.0)
+	}
+	for range h.Sent - len(h.RTTs) {
+		sb.WriteString("  *")
+	}
+	return sb.String()
+}
+
+type traceProbe struct {
+	ttl  int
+	sent time.Time
+}
+
+// Tracer discovers the routers on the path to Target with TTL limited UDP probes sent from Iface,
+// like traceroute. The ICMP errors are read from the error queue of the socket (IP_RECVERR),
+// so that neither a raw socket nor any privilege is needed.
+type Tracer struct {
+	Iface   string
+	Target  net.IP
+	MaxHops int
+	Probes  int
+	Timeout time.Duration
+
+	Source net.IP
+
+	version int
+	fd      int
+}
+
+func NewTracer(iface string, target net.IP) (*Tracer, error) {
+	t := &Tracer{
+		Iface:   iface,
+		Target:  target,
+		MaxHops: traceMaxHops,
+		Probes:  traceProbes,
+		Timeout: probeTimeout,
+		version: 6,
+		fd:      -1,
+	}
+	if target.To4() != nil {
+		t.version = 4
+	}
+
+	src, err := interfaceSource(iface, target)
+	if err != nil {
+		return nil, err
+	}
+	t.Source = src
+
+	if err := t.listen(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tracer) sockopts() (family, level, recverr, ttl int) {
+	if t.version == 4 {
+		return unix.AF_INET, unix.IPPROTO_IP, unix.IP_RECVERR, unix.IP_TTL
+	}
+	return unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, unix.IPV6_UNICAST_HOPS
+}
+
+func (t *Tracer) sockaddr(ip net.IP, port int) unix.Sockaddr {
+	if t.version == 4 {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip.To4())
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	if ip.IsLinkLocalUnicast() {
+		if ifi, err := net.InterfaceByName(t.Iface); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa
+}
+
+// listen opens a UDP socket bound to Iface that receives ICMP errors on its error queue
+func (t *Tracer) listen() error {
+	family, level, recverr, _ := t.sockopts()
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.IPPROTO_UDP)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	if err := unix.SetsockoptInt(fd, level, recverr, 1); err != nil {
+		unix.Close(fd)
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if err := unix.BindToDevice(fd, t.Iface); err != nil {
+		// SO_BINDTODEVICE needs CAP_NET_RAW before Linux 5.7, pin the source address instead
+		log.Debug().Err(err).Msgf("Binding traceroute socket to %s by source address %s", t.Iface, t.Source)
+		if err := unix.Bind(fd, t.sockaddr(t.Source, 0)); err != nil {
+			unix.Close(fd)
+			return os.NewSyscallError("bind", err)
+		}
+	}
+	t.fd = fd
+	return nil
+}
+
+func (t *Tracer) Close() error {
+	return unix.Close(t.fd)
+}
+
+func (t *Tracer) send(ttl, port int) error {
+	_, level, _, ttlOpt := t.sockopts()
+	if err := unix.SetsockoptInt(t.fd, level, ttlOpt, ttl); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	var err error
+	for range traceSendAttempts {
+		err = unix.Sendto(t.fd, make([]byte, tracePayload), 0, t.sockaddr(t.Target, port))
+		// the ICMP error of an earlier probe is also reported once as the error of the next send,
+		// which then fails without sending. The error stays on the error queue, so the send is repeated.
+		if !isICMPErrno(err) {
+			break
+		}
+	}
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	return nil
+}
+
+// isICMPErrno reports whether err is one of the errors the kernel converts ICMP errors to
+func isICMPErrno(err error) bool {
+	for _, errno := range []error{unix.EHOSTUNREACH, unix.ENETUNREACH, unix.ECONNREFUSED, unix.EACCES, unix.EPROTO} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run sends Probes rounds of probes with TTL 1 to MaxHops, each to its own destination port,
+// and returns the hops up to the first one that reached the target.
+func (t *Tracer) Run(ctx context.Context) ([]Hop, error) {
+	hops := make([]Hop, t.MaxHops)
+	for i := range hops {
+		hops[i].TTL = i + 1
+	}
+
+	pending := make(map[int]traceProbe)
+	reached := t.MaxHops + 1
+	total := t.MaxHops * t.Probes
+	next := 0
+	var nextSend, lastSent time.Time
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		if next < total && !now.Before(nextSend) {
+			ttl := next%t.MaxHops + 1
+			port := traceBasePort + next
+			next++
+			if ttl > reached {
+				continue
+			}
+			if err := t.send(ttl, port); err != nil {
+				return nil, fmt.Errorf("error sending traceroute probe to %s: %w", t.Target, err)
+			}
+			pending[port] = traceProbe{ttl: ttl, sent: now}
+			hops[ttl-1].Sent++
+			lastSent = now
+			nextSend = now.Add(traceProbeGap)
+			continue
+		}
+
+		wait := nextSend
+		if next >= total {
+			if len(pending) == 0 {
+				break
+			}
+			wait = lastSent.Add(t.Timeout)
+			if !now.Before(wait) {
+				break
+			}
+		}
+		if err := t.receive(wait.Sub(now), pending, hops, &reached); err != nil {
+			return nil, err
+		}
+	}
+
+	return hops[:min(reached, t.MaxHops)], nil
+}
+
+// receive waits up to timeout for ICMP errors and records them in the hop of their probe
+func (t *Tracer) receive(timeout time.Duration, pending map[int]traceProbe, hops []Hop, reached *int) error {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}}
+	ms := max(int(timeout.Milliseconds()), 1)
+	if _, err := unix.Poll(fds, ms); err != nil && !errors.Is(err, unix.EINTR) {
+		return os.NewSyscallError("poll", err)
+	}
+
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		_, oobn, _, from, err := unix.Recvmsg(t.fd, buf, oob, unix.MSG_ERRQUEUE)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return nil
+		}
+		if err != nil {
+			return os.NewSyscallError("recvmsg", err)
+		}
+		received := time.Now()
+
+		// the name of the message is the destination of the original probe
+		var port int
+		switch sa := from.(type) {
+		case *unix.SockaddrInet4:
+			port = sa.Port
+		case *unix.SockaddrInet6:
+			port = sa.Port
+		}
+		probe, ok := pending[port]
+		if !ok {
+			continue
+		}
+
+		addr, done, ok := t.parseError(oob[:oobn])
+		if !ok {
+			continue
+		}
+		delete(pending, port)
+
+		hop := &hops[probe.ttl-1]
+		if hop.Addr == "" {
+			hop.Addr = addr
+		}
+		hop.RTTs = append(hop.RTTs, received.Sub(probe.sent))
+		if done {
+			hop.Reached = true
+			*reached = min(*reached, probe.ttl)
+		}
+	}
+}
+
+// parseError returns the router that sent an ICMP error, and whether the error ends the path.
+// The control message is a struct sock_extended_err followed by the address of the router.
+func (t *Tracer) parseError(oob []byte) (addr string, done, ok bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return "", false, false
+	}
+	_, level, recverr, _ := t.sockopts()
+	for _, m := range msgs {
+		if int(m.Header.Level) != level || int(m.Header.Type) != recverr || len(m.Data) < sizeofEEHeader+8 {
+			continue
+		}
+		origin, typ, code := m.Data[4], m.Data[5], m.Data[6]
+		offender := m.Data[sizeofEEHeader:]
+
+		var ip net.IP
+		switch {
+		case origin == unix.SO_EE_ORIGIN_ICMP && binary.NativeEndian.Uint16(offender) == unix.AF_INET:
+			ip = net.IP(offender[4:8])
+			done = typ == icmpUnreachable
+			if typ != icmpTimeExceeded && !done {
+				continue
+			}
+			if done && code != icmpPortUnreachable {
+				log.Debug().Msgf("ICMP destination unreachable code %d from %s", code, ip)
+			}
+		case origin == unix.SO_EE_ORIGIN_ICMP6 && binary.NativeEndian.Uint16(offender) == unix.AF_INET6 && len(offender) >= 24:
+			ip = net.IP(offender[8:24])
+			done = typ == icmpv6Unreachable
+			if typ != icmpv6TimeExceeded && !done {
+				continue
+			}
+			if done && code != icmpv6PortUnreachable {
+				log.Debug().Msgf("ICMPv6 destination unreachable code %d from %s", code, ip)
+			}
+		default:
+			continue
+		}
+		return ip.String(), done, true
+	}
+	return "", false, false
+}
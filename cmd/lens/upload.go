@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	UploadBackendSwift   = "swift"
+	UploadBackendS3      = "s3"
+	UploadBackendPresign = "presign"
+)
+
+// Uploader stores result files in an object store
+type Uploader interface {
+	// Check verifies that the object store is reachable with the configured credentials
+	Check(ctx context.Context) error
+	// Upload stores the local file as key and returns only after the upload was verified
+	Upload(ctx context.Context, localPath, key string) error
+	String() string
+}
+
+func NewUploader(c *Config) (Uploader, error) {
+	switch backend := c.uploadBackend(); backend {
+	case UploadBackendSwift:
+		return &SwiftUploader{
+			username:  c.Swift.Username,
+			apiKey:    c.Swift.APIKey,
+			authURL:   c.Swift.AuthURL,
+			domain:    c.Swift.Domain,
+			tenant:    c.Swift.Tenant,
+			container: c.Swift.Container,
+		}, nil
+	case UploadBackendS3:
+		return NewS3Uploader(c.S3.Endpoint, c.S3.Region, c.S3.Bucket, c.S3.AccessKey, c.S3.SecretKey,
+			!c.S3.Insecure, c.S3.PathStyle, uint64(c.S3.PartSizeMB)<<20)
+	case UploadBackendPresign:
+		return NewPresignUploader(c.Presign.URL, c.Presign.Token), nil
+	case "":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown upload backend %q", backend)
+	}
+}
+
+// objectKey returns <ClientName>/<kind>/<year>/<month>/<date>/<filename> for a file finished now
+func objectKey(kind, filename string) string {
+	now := time.Now().UTC()
+	return path.Join(ClientName, kind, now.Format("2006"), now.Format("01"), now.Format(time.DateOnly), filename)
+}
+
+// uploadResult records a local result file in the manifest of today and queues it for upload.
+// session is the metadata of the measurement session the file belongs to, if any.
+// The file is kept when no upload backend is configured.
+func uploadResult(kind, localFilename string, session *SessionMeta) {
+	targetFilename := objectKey(kind, path.Base(localFilename))
+	if manifests != nil {
+		if err := manifests.Add(kind, localFilename, targetFilename, session); err != nil {
+			log.Error().Err(err).Msgf("Error adding %s to manifest", localFilename)
+		}
+	}
+	if spool == nil {
+		return
+	}
+
+	if err := spool.Enqueue(localFilename, targetFilename); err != nil {
+		log.Error().Err(err).Msgf("Error queueing %s for upload", localFilename)
+	}
+}
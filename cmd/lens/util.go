@@ -1,28 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
 	http "github.com/hashicorp/go-retryablehttp"
 	"github.com/phuslu/log"
 )
 
+// datetimeFormat is the UTC time in the names of result files
+const datetimeFormat = "2006-01-02-15-04-05"
+
 func datetimeString() string {
-	return time.Now().UTC().Format("2006-01-02-15-04-05")
+	return time.Now().UTC().Format(datetimeFormat)
 }
 
 func CheckDeps() error {
-	cmds := []string{"ping", "mtr", "traceroute", "dig", "curl", "tar"}
+	cmds := []string{"dig"}
 	if EnableIRTT {
 		cmds = append(cmds, "irtt")
 	}
@@ -36,257 +36,123 @@ func CheckDeps() error {
 	return nil
 }
 
-func ipExist(ip string) bool {
-	addrs, err := net.InterfaceAddrs()
+func interfaceAddrs(iface string) ([]net.Addr, error) {
+	ifi, err := net.InterfaceByName(iface)
 	if err != nil {
-		log.Error().Err(err).Msg("Error getting interface addresses")
-		return false
-	}
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To16() != nil {
-				if ipnet.IP.To16().String() == ip {
-					return true
-				}
-			}
-		}
+		return nil, err
 	}
-	return false
+	return ifi.Addrs()
 }
 
 func checkDirectory() string {
 	today := time.Now().UTC().Format("2006-01-02")
-	err := os.MkdirAll(path.Join("data", today), 0755)
+	err := os.MkdirAll(path.Join(DataDir, today), 0755)
 	if err != nil {
 		log.Error().Err(err).Msg("Error creating directory")
 	}
 	return today
 }
 
-func checkZstd() error {
-	cmds := []string{"zstd"}
-	for _, c := range cmds {
-		if _, err := exec.LookPath(c); err != nil {
-			if _, err := os.Stat(c); err != nil {
-				return fmt.Errorf("%s is not installed", c)
-			}
-		}
-	}
-
-	cmd := exec.Command("tar", "--zstd")
-	output, err := cmd.CombinedOutput()
-	// Normally, when zstd is installed,
-	// tar --zstd
-	// tar: You must specify one of the '-Acdtrux', '--delete' or '--test-label' options
-	// Try 'tar --help' or 'tar --usage' for more information.
-	// return code is $? = 2
-	// no need to check err, but to check output whether zstd is supported by this version of tar
-	if err != nil && strings.Contains(string(output), "unrecognized option") {
-		return errors.New("zstd is not supported")
-	}
-	return nil
-}
-
-func validResult(directory, filename string) error {
-	fullPath := path.Join(directory, filename)
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("error reading %s: %w", fullPath, err)
-	}
-	content := string(data)
-
-	// Match variants like:
-	// [1763071200.038727] 64 bytes from 100.64.0.1: icmp_seq=1 ttl=63 time=33.1 ms
-	// 64 bytes from 100.64.0.1: icmp_seq=1 ttl=63 time=33.1 ms
-	re := regexp.MustCompile(`(?m)(?:\[\d+(?:\.\d+)?\]\s*)?\d+\s+bytes\s+from\s+[0-9a-fA-F:\.]+:.*\btime=[0-9.]+(?:\s*ms)?`)
-	if re.FindStringIndex(content) != nil {
-		return nil
+// traceGateway traces the path to the gateway trace target of the IP version through iface and returns
+// the router at the given hop, or with hop 0, the first router outside the delegated prefix of external
+func traceGateway(iface string, version int, external net.IP, hop int) string {
+	log.Info().Msgf("Getting Starlink IPv%d active gateway", version)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	target := gatewayTraceTargets[version]
+	targets, err := net.DefaultResolver.LookupIP(ctx, fmt.Sprintf("ip%d", version), target)
+	if err != nil || len(targets) == 0 {
+		log.Error().Err(err).Msgf("Error resolving %s", target)
+		return ""
 	}
-
-	return fmt.Errorf("%s contains no valid ping results", fullPath)
-}
-
-func compress(directory, filename string) (string, error) {
-	fullFilename := path.Join(directory, filename)
-	fileInfo, err := os.Stat(fullFilename)
+	tracer, err := NewTracer(iface, targets[0])
 	if err != nil {
-		return "", fmt.Errorf("error stating file %s: %w", fullFilename, err)
-	}
-	if fileInfo.Size() == 0 {
-		return "", fmt.Errorf("%s is empty, skipping compression", fullFilename)
-	}
-	if err := validResult(directory, filename); err != nil {
-		return "", fmt.Errorf("no valid results in %s, skipping compression", fullFilename)
-	}
-
-	var cmd *exec.Cmd
-	if err := checkZstd(); err != nil {
-		cmd = exec.Command("tar", "-C", directory, "-cf", path.Join(directory, fmt.Sprintf("%s.tar.gz", filename)), filename, "--remove-files")
-		fullFilename = fmt.Sprintf("%s.tar.gz", fullFilename)
-	} else {
-		cmd = exec.Command("tar", "--zstd", "-C", directory, "-cf", path.Join(directory, fmt.Sprintf("%s.tar.zst", filename)), filename, "--remove-files")
-		fullFilename = fmt.Sprintf("%s.tar.zst", fullFilename)
+		log.Error().Err(err).Msg("Error creating tracer")
+		return ""
 	}
-	log.Debug().Msgf("Compression command: %s", cmd.String())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	defer tracer.Close()
+	tracer.MaxHops = max(hop, gatewayTraceMaxHops)
 
-	return fullFilename, cmd.Run()
-}
-
-func getExternalIP(version int) string {
-	if version != 4 && version != 6 {
-		version = 6
-	}
-	output, err := exec.Command("curl", fmt.Sprintf("-%d", version), "-m", "5", "-s", "--interface", Iface, "ifconfig.io").CombinedOutput()
+	hops, err := tracer.Run(ctx)
 	if err != nil {
-		log.Error().Err(err).Msgf("get external IP%d addresses failed: %s", version, string(output))
-		return ""
-	}
-	ip := strings.Trim(string(output), "\n")
-	if net.ParseIP(ip) == nil {
-		log.Error().Msgf("get external IP%d addresses failed: invalid IP %s", version, ip)
+		log.Error().Err(err).Msgf("Error tracing the path to %s", target)
 		return ""
 	}
-	return ip
-}
-
-func getStarlinkPoP(ip string) string {
-	pop, ok := geoipClient.GetPopByCIDR(ip)
-	if !ok {
-		return ""
+	for _, h := range hops {
+		log.Debug().Msgf("traceroute to %s: %s", targets[0], h)
 	}
-	return pop.Pop
-}
-
-// IntOrString is a helper to unmarshal JSON that may provide an integer
-// either as a number or as a quoted string.
-type IntOrString int
 
-func (i *IntOrString) UnmarshalJSON(b []byte) error {
-	// handle null/empty
-	s := strings.TrimSpace(string(b))
-	if s == "" || s == "null" {
-		*i = 0
-		return nil
-	}
-	// If it's a quoted string, trim quotes
-	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
-		s = strings.Trim(s, "\"")
-	}
-	// Try parse as integer from string form
-	if v, err := strconv.Atoi(s); err == nil {
-		*i = IntOrString(v)
-		return nil
-	}
-	// Fallback: try decoding as json.Number (handles numeric tokens)
-	var num json.Number
-	if err := json.Unmarshal(b, &num); err == nil {
-		if iv, err := num.Int64(); err == nil {
-			*i = IntOrString(iv)
-			return nil
+	if hop > 0 {
+		if hop > len(hops) || hops[hop-1].Addr == "" {
+			log.Error().Msgf("hop %d did not answer the traceroute", hop)
+			return ""
 		}
+		return hops[hop-1].Addr
 	}
-	return fmt.Errorf("cannot unmarshal %s", string(b))
-}
-
-type MTRResult struct {
-	Report struct {
-		Hubs []struct {
-			// mtr 0.93 uses "count" as string
-			// mtr 0.95 uses "count" as integer
-			Count IntOrString `json:"count"`
-			Host  string      `json:"host"`
-		}
+	h := gatewayHop(hops, external)
+	if h == nil {
+		log.Error().Msg("traceroute failed to detect gateway")
+		return ""
 	}
+	log.Info().Msgf("Detected Starlink IPv%d gateway at hop %d: %s", version, h.TTL, h.Addr)
+	return h.Addr
 }
 
-func getStarlinkIPv6ActiveGateway() string {
-	log.Info().Msg("Getting Starlink IPv6 active gateway")
-	cmd, err := exec.Command("mtr", "ipv6.google.com", "-n", "-m", IPv6GatewayHopCount, "-I", Iface, "-c", "1", "--json").CombinedOutput()
-	if err != nil {
-		log.Error().Err(err).Msgf("mtr failed: %s", string(cmd))
-	} else {
-		var mtrOutput MTRResult
-		err = json.Unmarshal([]byte(string(cmd)), &mtrOutput)
-		if err != nil {
-			log.Error().Err(err).Msg("Error unmarshalling mtr output")
-			return ""
+// gatewayHop returns the first hop with a global address outside the prefix Starlink delegates
+// to the terminal of external, so that routers of the customer in front of the gateway are skipped
+func gatewayHop(hops []Hop, external net.IP) *Hop {
+	delegated := delegatedPrefix(external)
+	for i := range hops {
+		ip := net.ParseIP(hops[i].Addr)
+		if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() || delegated.Contains(ip) {
+			continue
 		}
-		for _, h := range mtrOutput.Report.Hubs {
-			if strconv.Itoa(int(h.Count)) == IPv6GatewayHopCount {
-				return h.Host
-			}
-		}
-	}
-
-	log.Info().Msg("gateway not detected using mtr, trying traceroute")
-
-	output, err := exec.Command("traceroute",
-		"-6",
-		"-i", Iface,
-		"ipv6.google.com",
-		"-n",
-		"-m", IPv6GatewayHopCount,
-		"-f", IPv6GatewayHopCount,
-		"-q", "1").CombinedOutput()
-	if err != nil {
-		log.Error().Err(err).Msgf("traceroute failed: %s", string(output))
-		return ""
+		return &hops[i]
 	}
-	tracerouteResult := ""
-	tracerouteResult = string(output)
-	gateway := strings.Split(tracerouteResult, "\n")[len(strings.Split(tracerouteResult, "\n"))-2]
-	gateway = strings.Split(gateway, " ")[3]
-	if gateway == "*" || net.ParseIP(gateway).To16() == nil {
-		log.Error().Msg("traceroute failed to get gateway")
-		return ""
-	}
-	return gateway
+	return nil
 }
 
-func getGateway() string {
-	gatewayIP := ""
-	externalIP := ""
-	PoP = ""
-
-	if ManualSpecifiedGateway != "" {
-		if net.ParseIP(ManualSpecifiedGateway).To4() != nil {
-			IPVersion = 4
-		} else if len(net.ParseIP(ManualSpecifiedGateway)) == net.IPv6len {
-			IPVersion = 6
+// detectGateway finds the gateway of the terminal, and the external IP address used to look up its PoP
+func (t *Terminal) detectGateway() (gatewayIP, externalIP string, ipVersion int) {
+	if t.ManualGateway != "" {
+		if net.ParseIP(t.ManualGateway).To4() != nil {
+			ipVersion = 4
+		} else if len(net.ParseIP(t.ManualGateway)) == net.IPv6len {
+			ipVersion = 6
 		}
-		gatewayIP = ManualSpecifiedGateway
-	} else if !ActiveDish {
+		gatewayIP = t.ManualGateway
+	} else if !t.Active {
 		// With the rollout of standby mode, there are fewer inactive dishes.
 		// Inactive dishes cannot reach the Internet, but they can reach 100.64.0.1 or 198.54.100.0 (pop.anycast.starlinkisp.net).
-		if RouterGrpcAddrPort != "" {
-			exporter, err := NewGrpcClient(RouterGrpcAddrPort)
+		if t.RouterGrpc != "" {
+			exporter, err := NewGrpcClient(t.RouterGrpc, t.grpcIface())
 			if err != nil {
 				log.Error().Err(err).Msg("Error creating gRPC client to Starlink router")
-				return defaultIPv4CGNATGateway
+				return defaultIPv4CGNATGateway, "", 4
 			}
+			defer exporter.Conn.Close()
 			ipv6WanAddress := exporter.CollectIPv6WanAddress()
 			log.Info().Msgf("IPv6 WAN CIDR from Starlink router: %s", ipv6WanAddress)
 			_, ipnet, err := net.ParseCIDR(ipv6WanAddress)
 			if err != nil {
 				log.Error().Err(err).Msg("Error parsing IPv6 WAN address CIDR")
-				return defaultIPv4CGNATGateway
+				return defaultIPv4CGNATGateway, "", 4
 			}
-			IPVersion = 6
+			ipVersion = 6
 			// technically, this is not the external IP, but we use it to get the PoP info
 			externalIP = ipnet.IP.String()
 			// we still use the default CGNAT gateway for inactive dish
 			gatewayIP = defaultIPv4CGNATGateway
 			log.Info().Msgf("External IPv6 address from Starlink router: %s, gateway IP: %s", externalIP, gatewayIP)
 		} else {
-			// inactive dish, also bypassed, so no RouterGrpcAddrPort
+			// inactive dish, also bypassed, so no router gRPC address
 			// in this case, we collect the IPv6 address from the interface
-			addrs, err := net.InterfaceAddrs()
+			addrs, err := interfaceAddrs(t.Iface)
 			if err != nil {
 				log.Error().Err(err).Msg("Error getting interface addresses")
 				// we cannot get interface addresses, so we assume IPv4 CGNAT
-				IPVersion = 4
+				ipVersion = 4
 				gatewayIP = defaultIPv4CGNATGateway
 			}
 			for _, a := range addrs {
@@ -296,7 +162,7 @@ func getGateway() string {
 						_, ok := geoipClient.GetPopByCIDR(ipnet.IP.To16().String())
 						if ok {
 							// this is a Starlink IPv6 address
-							IPVersion = 6
+							ipVersion = 6
 							externalIP = ipnet.IP.To16().String()
 							// we still use the default CGNAT gateway for inactive dish
 							gatewayIP = defaultIPv4CGNATGateway
@@ -308,35 +174,58 @@ func getGateway() string {
 			}
 		}
 	} else {
-		// Active dish, probe IPv6 active gateway through mtr or traceroute
-		externalIPv6 = getExternalIP(6)
-		if ipExist(externalIPv6) {
+		// Active dish, probe IPv6 active gateway through traceroute
+		externalIPv6, err := externalIPs.Lookup(t.Iface, 6)
+		if err != nil {
+			log.Warn().Err(err).Msgf("External IPv6 address not detected%s", t.logSuffix())
+		}
+		if err == nil && externalIPv6.Local {
 			// If external IPv6 address exists on the interface
-			IPVersion = 6
+			ipVersion = 6
 
 			log.Info().Msgf("External IPv6 address: %s", externalIPv6)
-			externalIP = externalIPv6
-			gatewayIP = getStarlinkIPv6ActiveGateway()
+			externalIP = externalIPv6.String()
+			gatewayIP = traceGateway(t.Iface, 6, externalIPv6.Addr, t.IPv6GatewayHop)
+		} else if externalIPv4, err := externalIPs.Lookup(t.Iface, 4); err != nil {
+			log.Error().Err(err).Msgf("External IPv4 address not detected%s", t.logSuffix())
 		} else {
-			externalIPv4 = getExternalIP(4)
-			if net.ParseIP(externalIPv4).To4() != nil {
-				// CGNAT IPv4 does not exist on the interface locally
-				IPVersion = 4
-
-				log.Info().Msgf("External IPv4 address: %s", externalIPv4)
-				externalIP = externalIPv4
+			ipVersion = 4
+
+			log.Info().Msgf("External IPv4 address: %s (CGNAT: %t)", externalIPv4, externalIPv4.CGNAT)
+			externalIP = externalIPv4.String()
+			if externalIPv4.Local {
+				// a public IPv4 address on the interface has no CGNAT gateway in front of it
+				gatewayIP = traceGateway(t.Iface, 4, externalIPv4.Addr, 1)
+			} else {
 				gatewayIP = defaultIPv4CGNATGateway
 			}
 		}
 	}
 
-	if externalIP != "" {
-		PoP = getStarlinkPoP(externalIP)
+	return gatewayIP, externalIP, ipVersion
+}
+
+// notifyEvent posts a network event as JSON to EventsNotifyURL
+func notifyEvent(e *NetworkEvent) {
+	if EventsNotifyURL == "" {
+		return
 	}
-	StarlinkGateway = gatewayIP
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msg("Error marshalling network event")
+		return
+	}
+	client := http.NewClient()
+	client.HTTPClient.Timeout = 10 * time.Second
+	client.RetryMax = 3
 
-	log.Info().Msgf("Starlink gateway: %s, PoP: %s, external IP: %s", gatewayIP, PoP, externalIP)
-	return gatewayIP
+	resp, err := client.Post(EventsNotifyURL, "application/json", b)
+	if err != nil {
+		log.Error().Err(err).Msg("Error sending network event notification")
+		return
+	}
+	defer resp.Body.Close()
+	log.Debug().Msgf("Network event notification response status: %s", resp.Status)
 }
 
 func notify() {
@@ -0,0 +1,106 @@
+package geoip
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+)
+
+// Move is a prefix that is assigned to another PoP or city
+type Move struct {
+	Prefix netip.Prefix
+	From   PopInfo
+	To     PopInfo
+}
+
+// Diff lists the changes between two versions of the feed.
+// PoPs are compared by their code, prefixes by the masked prefix.
+type Diff struct {
+	AddedPoPs       []PopInfo
+	RemovedPoPs     []PopInfo
+	AddedPrefixes   []PopInfo
+	RemovedPrefixes []PopInfo
+	Moved           []Move
+}
+
+// Empty reports whether both versions assign the same prefixes to the same PoPs
+func (d *Diff) Empty() bool {
+	return len(d.AddedPoPs)+len(d.RemovedPoPs)+len(d.AddedPrefixes)+len(d.RemovedPrefixes)+len(d.Moved) == 0
+}
+
+// prefixMap maps the valid prefixes of entries to their PoP, later entries replace earlier ones like in NewTable
+func prefixMap(entries []PopInfo) map[netip.Prefix]PopInfo {
+	m := make(map[netip.Prefix]PopInfo, len(entries))
+	for _, e := range entries {
+		prefix, err := netip.ParsePrefix(e.CIDR)
+		if err != nil {
+			continue
+		}
+		m[prefix.Masked()] = e
+	}
+	return m
+}
+
+// popMap maps the PoP codes of prefixes to the city of their lowest prefix
+func popMap(prefixes map[netip.Prefix]PopInfo) map[string]PopInfo {
+	m := make(map[string]PopInfo)
+	for _, prefix := range sortedPrefixes(prefixes) {
+		if info := prefixes[prefix]; m[info.Pop].Pop == "" {
+			m[info.Pop] = PopInfo{Pop: info.Pop, City: info.City}
+		}
+	}
+	return m
+}
+
+func comparePrefix(a, b netip.Prefix) int {
+	return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+}
+
+func sortedPrefixes(m map[netip.Prefix]PopInfo) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(m))
+	for prefix := range m {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, comparePrefix)
+	return prefixes
+}
+
+// Compare returns the changes from the entries of an older to the entries of a newer version of the feed
+func Compare(before, after []PopInfo) *Diff {
+	oldPrefixes, newPrefixes := prefixMap(before), prefixMap(after)
+	oldPoPs, newPoPs := popMap(oldPrefixes), popMap(newPrefixes)
+
+	d := &Diff{}
+	for pop, info := range newPoPs {
+		if _, ok := oldPoPs[pop]; !ok {
+			d.AddedPoPs = append(d.AddedPoPs, info)
+		}
+	}
+	for pop, info := range oldPoPs {
+		if _, ok := newPoPs[pop]; !ok {
+			d.RemovedPoPs = append(d.RemovedPoPs, info)
+		}
+	}
+	byPop := func(a, b PopInfo) int {
+		return cmp.Compare(a.Pop, b.Pop)
+	}
+	slices.SortFunc(d.AddedPoPs, byPop)
+	slices.SortFunc(d.RemovedPoPs, byPop)
+
+	for _, prefix := range sortedPrefixes(newPrefixes) {
+		to := newPrefixes[prefix]
+		from, ok := oldPrefixes[prefix]
+		switch {
+		case !ok:
+			d.AddedPrefixes = append(d.AddedPrefixes, to)
+		case from.Pop != to.Pop || from.City != to.City:
+			d.Moved = append(d.Moved, Move{Prefix: prefix, From: from, To: to})
+		}
+	}
+	for _, prefix := range sortedPrefixes(oldPrefixes) {
+		if _, ok := newPrefixes[prefix]; !ok {
+			d.RemovedPrefixes = append(d.RemovedPrefixes, oldPrefixes[prefix])
+		}
+	}
+	return d
+}
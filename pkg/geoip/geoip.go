@@ -0,0 +1,324 @@
+// Package geoip looks up the Starlink PoP of an address in the GeoIP feed Starlink publishes
+// at https://geoip.starlinkisp.net/pops.csv. It is used by lens for the PoP of every terminal,
+// and can be used by offline analyses to look up large numbers of addresses.
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultURL is the GeoIP feed of Starlink
+const DefaultURL = "https://geoip.starlinkisp.net/pops.csv"
+
+type PopInfo struct {
+	CIDR string
+	Pop  string
+	City string
+}
+
+// cidr,pop,city
+// 14.1.64.0/24,mnlaphl1,mnl
+// 14.1.65.0/24,mnlaphl1,mnl
+// 14.1.66.0/24,mnlaphl1,mnl
+// 14.1.67.0/24,mnlaphl1,mnl
+// 14.1.72.0/24,mlbeaus1,mel
+
+// ParseCSV reads lines of the form cidr,pop,city
+func ParseCSV(r io.Reader) ([]PopInfo, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	var entries []PopInfo
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			continue
+		}
+		cidr := strings.TrimSpace(record[0])
+		if cidr == "" {
+			continue
+		}
+		entries = append(entries, PopInfo{
+			CIDR: cidr,
+			Pop:  strings.TrimSpace(record[1]),
+			City: strings.TrimSpace(record[2]),
+		})
+	}
+	return entries, nil
+}
+
+// LoadTable builds a table from a local copy of the feed
+func LoadTable(filename string) (*Table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := ParseCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	return NewTable(entries), nil
+}
+
+// Client holds the table of the feed at URL. Refresh replaces the table atomically,
+// so lookups are safe for concurrent use and never block on a refresh.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	// CacheFile keeps a copy of the last downloaded feed, and its ETag and Last-Modified header
+	// in CacheFile.meta.json, so that the table is available after a restart without network,
+	// and refreshes only download the feed when it changed. No copy is kept when CacheFile is empty.
+	CacheFile string
+	// SnapshotDir keeps a dated copy of every distinct version of the feed, see SaveSnapshot.
+	// No snapshots are kept when SnapshotDir is empty.
+	SnapshotDir string
+
+	// mu serializes refreshes, and guards etag and lastModified
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+
+	table   atomic.Pointer[Table]
+	updated atomic.Int64
+}
+
+// cacheMeta is stored next to the cached feed
+type cacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Fetched      string `json:"fetched"`
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Refresh downloads the feed and replaces the table. The request is conditional when the
+// feed was downloaded before, and changed is false when the feed was not modified since.
+func (c *Client) Refresh(ctx context.Context) (changed bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.table.Load() != nil {
+		if c.etag != "" {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		if c.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.lastModified)
+		}
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		c.updated.Store(time.Now().Unix())
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s answered %s", c.URL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("error downloading %s: %w", c.URL, err)
+	}
+	entries, err := ParseCSV(bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s: %w", c.URL, err)
+	}
+	table := NewTable(entries)
+	if table.Len() == 0 {
+		// keep the previous table rather than losing every PoP
+		return false, fmt.Errorf("%s contains no prefixes", c.URL)
+	}
+
+	now := time.Now()
+	c.etag = resp.Header.Get("ETag")
+	c.lastModified = resp.Header.Get("Last-Modified")
+	c.setTable(table, now)
+	if err := c.writeCache(body, now); err != nil {
+		return true, fmt.Errorf("error caching %s: %w", c.URL, err)
+	}
+	if err := c.snapshot(body, now); err != nil {
+		return true, fmt.Errorf("error keeping a snapshot of %s: %w", c.URL, err)
+	}
+	return true, nil
+}
+
+// LoadCache loads the table from CacheFile, and restores the validators of the cached feed
+// if it was downloaded from URL, so that the next refresh is conditional
+func (c *Client) LoadCache() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body, err := os.ReadFile(c.CacheFile)
+	if err != nil {
+		return err
+	}
+	entries, err := ParseCSV(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", c.CacheFile, err)
+	}
+	table := NewTable(entries)
+	if table.Len() == 0 {
+		return fmt.Errorf("%s contains no prefixes", c.CacheFile)
+	}
+
+	var meta cacheMeta
+	fetched := time.Time{}
+	if b, err := os.ReadFile(c.CacheFile + ".meta.json"); err == nil && json.Unmarshal(b, &meta) == nil && meta.URL == c.URL {
+		c.etag = meta.ETag
+		c.lastModified = meta.LastModified
+		// without a valid time, the table is outdated and replaced by the next refresh
+		if t, err := time.Parse(time.RFC3339, meta.Fetched); err == nil {
+			fetched = t
+		}
+	}
+	c.setTable(table, fetched)
+
+	// the cache of an earlier version of lens is the first snapshot
+	taken := fetched
+	if info, err := os.Stat(c.CacheFile); taken.IsZero() && err == nil {
+		taken = info.ModTime()
+	}
+	if err := c.snapshot(body, taken); err != nil {
+		return fmt.Errorf("error keeping a snapshot of %s: %w", c.CacheFile, err)
+	}
+	return nil
+}
+
+// snapshot keeps body in SnapshotDir if it differs from the latest snapshot
+func (c *Client) snapshot(body []byte, taken time.Time) error {
+	if c.SnapshotDir == "" {
+		return nil
+	}
+	_, _, err := SaveSnapshot(c.SnapshotDir, body, taken)
+	return err
+}
+
+// LoadFile loads the table from a local copy of the feed, e.g. one bundled with a package.
+// The table is considered outdated, so that it is replaced by the next refresh.
+func (c *Client) LoadFile(filename string) error {
+	table, err := LoadTable(filename)
+	if err != nil {
+		return err
+	}
+	if table.Len() == 0 {
+		return fmt.Errorf("%s contains no prefixes", filename)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etag, c.lastModified = "", ""
+	c.setTable(table, time.Time{})
+	return nil
+}
+
+func (c *Client) writeCache(body []byte, fetched time.Time) error {
+	if c.CacheFile == "" {
+		return nil
+	}
+	meta, err := json.MarshalIndent(cacheMeta{
+		URL:          c.URL,
+		ETag:         c.etag,
+		LastModified: c.lastModified,
+		Fetched:      fetched.UTC().Format(time.RFC3339),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.CacheFile), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.CacheFile, body); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.CacheFile+".meta.json", meta)
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to filename
+func writeFileAtomic(filename string, b []byte) error {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// SetTable replaces the table, e.g. with one loaded from a local copy of the feed
+func (c *Client) SetTable(t *Table) {
+	c.setTable(t, time.Now())
+}
+
+func (c *Client) setTable(t *Table, updated time.Time) {
+	c.table.Store(t)
+	if updated.IsZero() {
+		c.updated.Store(0)
+	} else {
+		c.updated.Store(updated.Unix())
+	}
+}
+
+// Table returns the current table, nil before the first refresh
+func (c *Client) Table() *Table {
+	return c.table.Load()
+}
+
+// Updated returns the time of the last successful refresh, zero before the first one
+func (c *Client) Updated() time.Time {
+	if s := c.updated.Load(); s != 0 {
+		return time.Unix(s, 0)
+	}
+	return time.Time{}
+}
+
+// Lookup returns the PoP of the longest prefix that contains addr
+func (c *Client) Lookup(addr netip.Addr) (PopInfo, bool) {
+	return c.Table().Lookup(addr)
+}
+
+// GetPopByCIDR returns the PoP of an address, or of the network address of a CIDR
+func (c *Client) GetPopByCIDR(cidr string) (PopInfo, bool) {
+	cidr = strings.TrimSpace(cidr)
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return PopInfo{}, false
+		}
+		addr = prefix.Masked().Addr()
+	}
+	return c.Lookup(addr)
+}
@@ -0,0 +1,89 @@
+package geoip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// snapshotTimeFormat is the UTC time a snapshot was downloaded, in its filename pops-<time>.csv
+const snapshotTimeFormat = "20060102T150405Z"
+
+// Snapshot is a dated copy of one version of the feed
+type Snapshot struct {
+	Time     time.Time
+	Filename string
+}
+
+func snapshotFilename(dir string, t time.Time) string {
+	return filepath.Join(dir, "pops-"+t.UTC().Format(snapshotTimeFormat)+".csv")
+}
+
+// ListSnapshots returns the snapshots in dir, oldest first
+func ListSnapshots(dir string) ([]Snapshot, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "pops-*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0, len(filenames))
+	for _, filename := range filenames {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), "pops-"), ".csv")
+		t, err := time.Parse(snapshotTimeFormat, name)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Time: t, Filename: filename})
+	}
+	slices.SortFunc(snapshots, func(a, b Snapshot) int {
+		return a.Time.Compare(b.Time)
+	})
+	return snapshots, nil
+}
+
+// SaveSnapshot keeps body as a snapshot taken at t, unless it is the same as the latest snapshot in dir,
+// or t is not after the latest snapshot. A feed that changes back to an earlier version is kept again,
+// so that the snapshots are a history of the feed.
+func SaveSnapshot(dir string, body []byte, t time.Time) (filename string, saved bool, err error) {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return "", false, err
+	}
+	// snapshots are named by the second they were taken
+	t = t.Truncate(time.Second)
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		if b, err := os.ReadFile(latest.Filename); err == nil && sha256.Sum256(b) == sha256.Sum256(body) {
+			return latest.Filename, false, nil
+		}
+		if !t.After(latest.Time) {
+			return latest.Filename, false, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", false, err
+	}
+	filename = snapshotFilename(dir, t)
+	if err := writeFileAtomic(filename, body); err != nil {
+		return "", false, err
+	}
+	return filename, true, nil
+}
+
+// LoadSnapshot reads the entries of a snapshot, or of any other copy of the feed
+func LoadSnapshot(filename string) ([]PopInfo, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ParseCSV(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	return entries, nil
+}
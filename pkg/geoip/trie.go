@@ -0,0 +1,153 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// uint128 is an IPv6 address, or an IPv4-mapped IPv6 address, as two big endian words
+type uint128 struct {
+	hi, lo uint64
+}
+
+func fromAddr(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+// bit returns bit i, counted from the most significant bit
+func (u uint128) bit(i int) int {
+	if i < 64 {
+		return int(u.hi>>(63-i)) & 1
+	}
+	return int(u.lo>>(127-i)) & 1
+}
+
+// commonBits returns the number of leading bits u and v share
+func (u uint128) commonBits(v uint128) int {
+	if d := u.hi ^ v.hi; d != 0 {
+		return bits.LeadingZeros64(d)
+	}
+	return 64 + bits.LeadingZeros64(u.lo^v.lo)
+}
+
+// node is a node of a path-compressed binary trie. Its prefix is the first bits of addr,
+// and covers the prefixes of its children, which continue with a 0 and a 1 bit.
+// info is nil for nodes that only join two branches.
+type node struct {
+	addr  uint128
+	bits  int
+	info  *PopInfo
+	child [2]*node
+}
+
+// Table maps IPv4 and IPv6 prefixes to PoPs and finds the longest matching prefix of an address.
+// IPv4 prefixes are stored as IPv4-mapped IPv6 prefixes in a trie of their own, so that IPv6 prefixes
+// never contain IPv4 addresses. A Table is not modified after it is built, so it is safe for concurrent use.
+type Table struct {
+	v4   *node
+	v6   *node
+	size int
+}
+
+// NewTable builds a table of entries. Entries with an invalid CIDR are skipped,
+// later entries replace earlier ones with the same CIDR, and prefixes of staging PoPs are left out.
+func NewTable(entries []PopInfo) *Table {
+	prefixes := make([]netip.Prefix, len(entries))
+	last := make(map[netip.Prefix]int, len(entries))
+	for i, e := range entries {
+		prefix, err := netip.ParsePrefix(e.CIDR)
+		if err != nil {
+			continue
+		}
+		prefixes[i] = prefix.Masked()
+		last[prefixes[i]] = i
+	}
+
+	t := &Table{}
+	for i, e := range entries {
+		if !prefixes[i].IsValid() || last[prefixes[i]] != i || e.City == "staging" {
+			continue
+		}
+		root, bits := &t.v6, prefixes[i].Bits()
+		if prefixes[i].Addr().Is4() {
+			root, bits = &t.v4, bits+96
+		}
+		t.insert(root, fromAddr(prefixes[i].Addr()), bits, e)
+	}
+	return t
+}
+
+// Len returns the number of prefixes in the table
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+func (t *Table) insert(n **node, addr uint128, prefixBits int, info PopInfo) {
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &node{addr: addr, bits: prefixBits, info: &info}
+			t.size++
+			return
+		}
+
+		common := min(cur.addr.commonBits(addr), cur.bits, prefixBits)
+		if common == cur.bits {
+			if common == prefixBits {
+				if cur.info == nil {
+					t.size++
+				}
+				cur.info = &info
+				return
+			}
+			n = &cur.child[addr.bit(common)]
+			continue
+		}
+
+		// the prefix branches off within the prefix of cur, or covers it
+		parent := &node{addr: addr, bits: common}
+		parent.child[cur.addr.bit(common)] = cur
+		if common == prefixBits {
+			parent.info = &info
+		} else {
+			parent.child[addr.bit(common)] = &node{addr: addr, bits: prefixBits, info: &info}
+		}
+		*n = parent
+		t.size++
+		return
+	}
+}
+
+// Lookup returns the PoP of the longest prefix that contains addr.
+// IPv4-mapped IPv6 addresses are looked up as IPv4 addresses.
+func (t *Table) Lookup(addr netip.Addr) (PopInfo, bool) {
+	if t == nil || !addr.IsValid() {
+		return PopInfo{}, false
+	}
+	addr = addr.Unmap()
+	root := t.v6
+	if addr.Is4() {
+		root = t.v4
+	}
+	a := fromAddr(addr)
+
+	var best *PopInfo
+	for n := root; n != nil && a.commonBits(n.addr) >= n.bits; {
+		if n.info != nil {
+			best = n.info
+		}
+		if n.bits == 128 {
+			break
+		}
+		n = n.child[a.bit(n.bits)]
+	}
+	if best == nil {
+		return PopInfo{}, false
+	}
+	return *best, true
+}
@@ -0,0 +1,296 @@
+package geoip
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestTableLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []PopInfo
+		addr    string
+		want    string
+		wantOK  bool
+		wantLen int
+	}{
+		{
+			name:    "covering prefix",
+			entries: []PopInfo{{"10.0.0.0/8", "a", "x"}, {"10.1.0.0/16", "b", "x"}},
+			addr:    "10.2.3.4",
+			want:    "a", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "longest prefix",
+			entries: []PopInfo{{"10.0.0.0/8", "a", "x"}, {"10.1.0.0/16", "b", "x"}},
+			addr:    "10.1.3.4",
+			want:    "b", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "covering prefix inserted after the longer one",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.0.0.0/8", "a", "x"}},
+			addr:    "10.1.3.4",
+			want:    "b", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "covering prefix inserted after the longer one, other branch",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.0.0.0/8", "a", "x"}},
+			addr:    "10.200.3.4",
+			want:    "a", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "split node",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.2.0.0/16", "c", "x"}},
+			addr:    "10.2.0.1",
+			want:    "c", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "split node without prefix",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.2.0.0/16", "c", "x"}},
+			addr:    "10.3.0.1",
+			wantLen: 2,
+		},
+		{
+			name:    "prefix inserted at a split node",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.2.0.0/16", "c", "x"}, {"10.0.0.0/14", "a", "x"}},
+			addr:    "10.3.0.1",
+			want:    "a", wantOK: true, wantLen: 3,
+		},
+		{
+			name:    "IPv4-mapped address",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}},
+			addr:    "::ffff:10.1.2.3",
+			want:    "b", wantOK: true, wantLen: 1,
+		},
+		{
+			name:    "IPv6 prefixes do not contain IPv4 addresses",
+			entries: []PopInfo{{"::/0", "v6", "x"}},
+			addr:    "10.1.2.3",
+			wantLen: 1,
+		},
+		{
+			name:    "IPv4 default route",
+			entries: []PopInfo{{"0.0.0.0/0", "v4", "x"}, {"::/0", "v6", "x"}},
+			addr:    "192.0.2.1",
+			want:    "v4", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "IPv6 prefix",
+			entries: []PopInfo{{"2605:59c8::/32", "a", "x"}, {"2605:59c8:1000::/40", "b", "x"}},
+			addr:    "2605:59c8:10ff::1",
+			want:    "b", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "duplicate CIDR",
+			entries: []PopInfo{{"10.1.0.0/16", "old", "x"}, {"10.1.0.0/16", "new", "x"}},
+			addr:    "10.1.2.3",
+			want:    "new", wantOK: true, wantLen: 1,
+		},
+		{
+			name:    "duplicate CIDR with host bits",
+			entries: []PopInfo{{"10.1.0.0/16", "old", "x"}, {"10.1.2.3/16", "new", "x"}},
+			addr:    "10.1.200.3",
+			want:    "new", wantOK: true, wantLen: 1,
+		},
+		{
+			name:    "staging PoP",
+			entries: []PopInfo{{"10.0.0.0/8", "a", "x"}, {"10.1.0.0/16", "stg", "staging"}},
+			addr:    "10.1.2.3",
+			want:    "a", wantOK: true, wantLen: 1,
+		},
+		{
+			name:    "staging replaces duplicate",
+			entries: []PopInfo{{"10.1.0.0/16", "b", "x"}, {"10.1.0.0/16", "stg", "staging"}},
+			addr:    "10.1.2.3",
+			wantLen: 0,
+		},
+		{
+			name:    "/32 leaf",
+			entries: []PopInfo{{"192.0.2.0/24", "net", "x"}, {"192.0.2.1/32", "host", "x"}},
+			addr:    "192.0.2.1",
+			want:    "host", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "next to a /32 leaf",
+			entries: []PopInfo{{"192.0.2.0/24", "net", "x"}, {"192.0.2.1/32", "host", "x"}},
+			addr:    "192.0.2.2",
+			want:    "net", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "/128 leaf",
+			entries: []PopInfo{{"2001:db8::/32", "net", "x"}, {"2001:db8::1/128", "host", "x"}},
+			addr:    "2001:db8::1",
+			want:    "host", wantOK: true, wantLen: 2,
+		},
+		{
+			name:    "next to a /128 leaf",
+			entries: []PopInfo{{"2001:db8::1/128", "host", "x"}},
+			addr:    "2001:db8::",
+			wantLen: 1,
+		},
+		{
+			name:    "invalid CIDR",
+			entries: []PopInfo{{"10.1.0.0/33", "bad", "x"}, {"not a prefix", "bad", "x"}, {"10.0.0.0/8", "a", "x"}},
+			addr:    "10.1.2.3",
+			want:    "a", wantOK: true, wantLen: 1,
+		},
+		{
+			name:    "invalid address",
+			entries: []PopInfo{{"0.0.0.0/0", "v4", "x"}},
+			wantLen: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewTable(tt.entries)
+			if table.Len() != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", table.Len(), tt.wantLen)
+			}
+			var addr netip.Addr
+			if tt.addr != "" {
+				addr = netip.MustParseAddr(tt.addr)
+			}
+			got, ok := table.Lookup(addr)
+			if ok != tt.wantOK || got.Pop != tt.want {
+				t.Errorf("Lookup(%s) = %q, %t, want %q, %t", tt.addr, got.Pop, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTableNil(t *testing.T) {
+	var table *Table
+	if table.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", table.Len())
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Error("Lookup() in a nil table found a PoP")
+	}
+}
+
+// TestTableLookupRandom compares the trie with a linear search for the longest prefix
+func TestTableLookupRandom(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	entries := make([]PopInfo, 0, 2000)
+	for i := range cap(entries) {
+		var prefix netip.Prefix
+		if i%2 == 0 {
+			// short prefixes in a small space, so that they cover each other
+			b := [4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))}
+			prefix = netip.PrefixFrom(netip.AddrFrom4(b), 8+r.IntN(25))
+		} else {
+			b := [16]byte{0x26, 0x05, 0x59, 0xc8, byte(r.IntN(4)), byte(r.IntN(256))}
+			for j := 6; j < 16; j++ {
+				b[j] = byte(r.IntN(256))
+			}
+			prefix = netip.PrefixFrom(netip.AddrFrom16(b), 32+r.IntN(97))
+		}
+		entries = append(entries, PopInfo{CIDR: prefix.String(), Pop: fmt.Sprintf("pop%d", i), City: "x"})
+	}
+	table := NewTable(entries)
+
+	prefixes := make(map[netip.Prefix]PopInfo)
+	for _, e := range entries {
+		prefixes[netip.MustParsePrefix(e.CIDR).Masked()] = e
+	}
+	if table.Len() != len(prefixes) {
+		t.Errorf("Len() = %d, want %d", table.Len(), len(prefixes))
+	}
+
+	for i := range 20000 {
+		var addr netip.Addr
+		if i%2 == 0 {
+			addr = netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))})
+		} else {
+			b := [16]byte{0x26, 0x05, 0x59, 0xc8, byte(r.IntN(4)), byte(r.IntN(256))}
+			for j := 6; j < 16; j++ {
+				b[j] = byte(r.IntN(256))
+			}
+			addr = netip.AddrFrom16(b)
+		}
+
+		var want PopInfo
+		wantBits := -1
+		for prefix, info := range prefixes {
+			if prefix.Contains(addr) && prefix.Bits() > wantBits {
+				want, wantBits = info, prefix.Bits()
+			}
+		}
+		got, ok := table.Lookup(addr)
+		if ok != (wantBits >= 0) || got != want {
+			t.Fatalf("Lookup(%s) = %v, %t, want %v, %t", addr, got, ok, want, wantBits >= 0)
+		}
+	}
+}
+
+// benchmarkFeed returns entries shaped like the feed: IPv4 /24s and IPv6 /48s of a few thousand PoP prefixes,
+// and addresses to look up, of which most are in the feed
+func benchmarkFeed() ([]PopInfo, []netip.Addr) {
+	r := rand.New(rand.NewPCG(3, 4))
+	pops := []string{"sfiabgr1", "lsancax1", "dnvrcox1", "sttlwax1", "frntdeu1", "lndngbr1", "tkyojpn1", "sydyaus1"}
+
+	entries := make([]PopInfo, 0, 8000)
+	for range 5000 {
+		b := [4]byte{byte(14 + r.IntN(200)), byte(r.IntN(256)), byte(r.IntN(256)), 0}
+		pop := pops[r.IntN(len(pops))]
+		entries = append(entries, PopInfo{CIDR: netip.PrefixFrom(netip.AddrFrom4(b), 24).String(), Pop: pop, City: pop[:3]})
+	}
+	for range 3000 {
+		b := [16]byte{0x26, 0x05, 0x59, 0xc8, byte(r.IntN(256)), byte(r.IntN(256))}
+		pop := pops[r.IntN(len(pops))]
+		entries = append(entries, PopInfo{CIDR: netip.PrefixFrom(netip.AddrFrom16(b), 48).String(), Pop: pop, City: pop[:3]})
+	}
+
+	addrs := make([]netip.Addr, 0, 4096)
+	for len(addrs) < cap(addrs) {
+		prefix := netip.MustParsePrefix(entries[r.IntN(len(entries))].CIDR)
+		b := prefix.Addr().AsSlice()
+		b[len(b)-1] = byte(r.IntN(256))
+		addr, _ := netip.AddrFromSlice(b)
+		if r.IntN(10) == 0 {
+			// an address outside the feed
+			addr = netip.AddrFrom4([4]byte{byte(r.IntN(14)), byte(r.IntN(256)), byte(r.IntN(256)), byte(r.IntN(256))})
+		}
+		addrs = append(addrs, addr)
+	}
+	return entries, addrs
+}
+
+func BenchmarkNewTable(b *testing.B) {
+	entries, _ := benchmarkFeed()
+	for b.Loop() {
+		NewTable(entries)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	entries, addrs := benchmarkFeed()
+	table := NewTable(entries)
+	b.ReportAllocs()
+	i := 0
+	for b.Loop() {
+		table.Lookup(addrs[i%len(addrs)])
+		i++
+	}
+}
+
+func BenchmarkGetPopByCIDR(b *testing.B) {
+	entries, addrs := benchmarkFeed()
+	c := NewClient(DefaultURL)
+	c.SetTable(NewTable(entries))
+	cidrs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		cidrs[i] = addr.String()
+		if i%2 == 0 {
+			cidrs[i] = netip.PrefixFrom(addr, addr.BitLen()-8).String()
+		}
+	}
+	b.ReportAllocs()
+	i := 0
+	for b.Loop() {
+		c.GetPopByCIDR(cidrs[i%len(cidrs)])
+		i++
+	}
+}